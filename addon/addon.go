@@ -11,6 +11,16 @@ type Addon interface {
 	Handler() gin.HandlerFunc
 }
 
+// Middleware is implemented by addons that need to act on every request,
+// e.g., to change the pipeline that is used to search for conversations.
+type Middleware interface {
+	Middleware() gin.HandlerFunc
+}
+
 var Addons = map[string]Addon{
-	"evaluation": NewEvaluationAddon(),
+	"evaluation":   NewEvaluationAddon(),
+	"logging":      NewLoggingAddon(),
+	"userstudy":    NewUserStudyAddon(),
+	"assessment":   NewAssessmentAddon(),
+	"interleaving": NewInterleavingAddon(),
 }
@@ -0,0 +1,539 @@
+package addon
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	_ "embed"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	"github.com/ielab/pecan"
+	"github.com/olivere/elastic/v7"
+	"html/template"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//go:embed assessment.html
+var assessmentTemplate string
+
+// judgement is a line of the output file of the assessment addon.
+// When an assessor judges an item more than once, their latest judgement is the one that counts.
+// Assessor identifies who made the judgement, and Name is only the name they chose to be shown by.
+type judgement struct {
+	Time     time.Time `json:"time"`
+	Assessor string    `json:"assessor"`
+	Name     string    `json:"name,omitempty"`
+	Topic    string    `json:"topic"`
+	Item     string    `json:"item"`
+	Grade    int       `json:"grade"`
+}
+
+// AssessorProgress is how many of the items of a topic an assessor has judged.
+type AssessorProgress struct {
+	Assessor string
+	Judged   int
+}
+
+// TopicProgress is the progress of each assessor of a topic.
+type TopicProgress struct {
+	Topic     pecan.PoolTopic
+	Judged    int
+	Assessors []AssessorProgress
+}
+
+// Agreement is how often two assessors gave the same grade to the items they both judged,
+// both as a proportion and corrected for chance as Cohen's kappa.
+type Agreement struct {
+	A, B     string
+	Items    int
+	Observed float64
+	Kappa    float64
+}
+
+// AssessmentAddon collects graded relevance judgements for the items of a pool, so that qrels can be built.
+// Items are shown with their surrounding context: conversations are shown in full, and messages are shown
+// within the conversation formed around them by TimeBounder.
+type AssessmentAddon struct {
+	sync.Mutex
+	es        *elastic.Client
+	api       pecan.ChatAPI
+	index     string
+	pool      pecan.Pool
+	grades    []pecan.Grade
+	exportKey string
+	output    *os.File
+	page      *template.Template
+
+	// judgements are the grades of items keyed by topic, item, and then assessor.
+	judgements map[string]map[string]map[string]int
+	// names are the names that assessors last chose to be shown by.
+	names map[string]string
+}
+
+func NewAssessmentAddon() *AssessmentAddon {
+	return &AssessmentAddon{
+		judgements: make(map[string]map[string]map[string]int),
+		names:      make(map[string]string),
+	}
+}
+
+func (addon *AssessmentAddon) Initialise(es *elastic.Client, api pecan.ChatAPI, config *pecan.Config) {
+	addon.es = es
+	addon.api = api
+	addon.index = config.Elasticsearch.Index
+
+	var err error
+	addon.pool, err = pecan.ReadPool(config.Assessment.Pool)
+	if err != nil {
+		panic(err)
+	}
+	addon.grades = config.Assessment.Grades
+	if len(addon.grades) == 0 {
+		addon.grades = pecan.DefaultGrades
+	}
+
+	output := config.Assessment.Output
+	if len(output) == 0 {
+		output = "assessment.jsonl"
+	}
+	err = addon.replay(output)
+	if err != nil {
+		panic(err)
+	}
+	addon.output, err = os.OpenFile(output, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		panic(err)
+	}
+
+	addon.exportKey = config.Assessment.ExportKey
+	addon.page = template.Must(template.New("assessment").Parse(assessmentTemplate))
+}
+
+// replay restores the judgements made in a previous run of the addon.
+func (addon *AssessmentAddon) replay(path string) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var j judgement
+		if err := json.Unmarshal(scanner.Bytes(), &j); err != nil {
+			return err
+		}
+		addon.judge(j)
+	}
+	return scanner.Err()
+}
+
+// judge sets the grade an assessor gave an item. The caller must hold the lock.
+func (addon *AssessmentAddon) judge(j judgement) {
+	items, ok := addon.judgements[j.Topic]
+	if !ok {
+		items = make(map[string]map[string]int)
+		addon.judgements[j.Topic] = items
+	}
+	assessors, ok := items[j.Item]
+	if !ok {
+		assessors = make(map[string]int)
+		items[j.Item] = assessors
+	}
+	assessors[j.Assessor] = j.Grade
+	if len(j.Name) > 0 {
+		addon.names[j.Assessor] = j.Name
+	}
+}
+
+// record appends a judgement to the output and applies it. The caller must hold the lock.
+func (addon *AssessmentAddon) record(j judgement) {
+	j.Time = time.Now()
+	b, err := json.Marshal(j)
+	if err != nil {
+		panic(err)
+	}
+	_, err = addon.output.Write(append(b, '\n'))
+	if err != nil {
+		panic(err)
+	}
+	addon.judge(j)
+}
+
+func (addon *AssessmentAddon) topic(id string) (pecan.PoolTopic, bool) {
+	for _, topic := range addon.pool.Topics {
+		if topic.Id == id {
+			return topic, true
+		}
+	}
+	return pecan.PoolTopic{}, false
+}
+
+func (addon *AssessmentAddon) validGrade(grade int) bool {
+	for _, g := range addon.grades {
+		if g.Value == grade {
+			return true
+		}
+	}
+	return false
+}
+
+// nextItem is the position of the first item of the topic after position i that the assessor has not judged,
+// wrapping around to the start of the topic. It is -1 when the assessor has judged every item.
+// The caller must hold the lock.
+func (addon *AssessmentAddon) nextItem(topic pecan.PoolTopic, assessor string, i int) int {
+	for k := 1; k <= len(topic.Items); k++ {
+		j := (i + k) % len(topic.Items)
+		if _, ok := addon.judgements[topic.Id][topic.Items[j]][assessor]; !ok {
+			return j
+		}
+	}
+	return -1
+}
+
+// progress is the number of items of each topic judged by each assessor. The caller must hold the lock.
+func (addon *AssessmentAddon) progress() []TopicProgress {
+	progress := make([]TopicProgress, len(addon.pool.Topics))
+	for i, topic := range addon.pool.Topics {
+		judged := make(map[string]int)
+		for _, item := range topic.Items {
+			for assessor := range addon.judgements[topic.Id][item] {
+				judged[assessor]++
+			}
+		}
+		progress[i].Topic = topic
+		for _, item := range topic.Items {
+			if len(addon.judgements[topic.Id][item]) > 0 {
+				progress[i].Judged++
+			}
+		}
+		for assessor, n := range judged {
+			progress[i].Assessors = append(progress[i].Assessors, AssessorProgress{Assessor: assessor, Judged: n})
+		}
+		sort.Slice(progress[i].Assessors, func(a, b int) bool {
+			return progress[i].Assessors[a].Assessor < progress[i].Assessors[b].Assessor
+		})
+	}
+	return progress
+}
+
+// agreement is the agreement between each pair of assessors over every topic. The caller must hold the lock.
+func (addon *AssessmentAddon) agreement() []Agreement {
+	type pair struct{ a, b string }
+	shared := make(map[pair][][2]int)
+	for _, items := range addon.judgements {
+		for _, assessors := range items {
+			for a, ga := range assessors {
+				for b, gb := range assessors {
+					if a < b {
+						shared[pair{a, b}] = append(shared[pair{a, b}], [2]int{ga, gb})
+					}
+				}
+			}
+		}
+	}
+
+	var agreements []Agreement
+	for p, grades := range shared {
+		n := float64(len(grades))
+		var agree float64
+		countA := make(map[int]float64)
+		countB := make(map[int]float64)
+		for _, g := range grades {
+			if g[0] == g[1] {
+				agree++
+			}
+			countA[g[0]]++
+			countB[g[1]]++
+		}
+		observed := agree / n
+		var expected float64
+		for grade, c := range countA {
+			expected += (c / n) * (countB[grade] / n)
+		}
+		kappa := 1.0
+		if expected < 1 {
+			kappa = (observed - expected) / (1 - expected)
+		}
+		agreements = append(agreements, Agreement{A: p.a, B: p.b, Items: len(grades), Observed: observed, Kappa: kappa})
+	}
+	sort.Slice(agreements, func(i, j int) bool {
+		if agreements[i].A != agreements[j].A {
+			return agreements[i].A < agreements[j].A
+		}
+		return agreements[i].B < agreements[j].B
+	})
+	return agreements
+}
+
+// qrels writes the judgements as TREC qrels. When assessor is empty, the grade of an item is the
+// grade most assessors gave it, with ties going to the lower grade. The caller must hold the lock.
+func (addon *AssessmentAddon) qrels(assessor string) []byte {
+	var buf bytes.Buffer
+	for _, topic := range addon.pool.Topics {
+		for _, item := range topic.Items {
+			assessors, ok := addon.judgements[topic.Id][item]
+			if !ok {
+				continue
+			}
+			var grade int
+			if len(assessor) > 0 {
+				if grade, ok = assessors[assessor]; !ok {
+					continue
+				}
+			} else {
+				votes := make(map[int]int)
+				for _, g := range assessors {
+					votes[g]++
+				}
+				best := -1
+				for g, v := range votes {
+					if v > best || (v == best && g < grade) {
+						grade, best = g, v
+					}
+				}
+			}
+			fmt.Fprintf(&buf, "%s 0 %s %d\n", topic.Id, item, grade)
+		}
+	}
+	return buf.Bytes()
+}
+
+// context retrieves the messages to show for an item, checking that the assessor can read them.
+func (addon *AssessmentAddon) context(c *gin.Context, item string) ([]pecan.Message, bool, error) {
+	ctx := context.Background()
+	request := pecan.SearchRequest{Index: addon.index, Context: c}
+	if id, err := pecan.ParseConversationID(item); err == nil {
+		conversation, err := pecan.NewTaskExecutor(addon.api, addon.es).GetConversation(ctx, addon.api, id, request)
+		if errors.Is(err, pecan.ErrChannelForbidden) {
+			return nil, false, nil
+		}
+		return conversation.Messages, true, err
+	}
+
+	message, err := pecan.GetMessage(addon.es, addon.api, ctx, item, request)
+	if errors.Is(err, pecan.ErrChannelForbidden) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	messages, err := pecan.TimeBounder(addon.es, addon.api, ctx, message.Channel, message, request)
+	if err != nil {
+		return nil, true, err
+	}
+	for i := range messages {
+		if messages[i].Id == message.Id {
+			messages[i].Hit = true
+		}
+	}
+	return messages, true, nil
+}
+
+type assessmentPage struct {
+	Assessor   string
+	Names      map[string]string
+	Grades     []pecan.Grade
+	Progress   []TopicProgress
+	Agreements []Agreement
+
+	Topic    pecan.PoolTopic
+	Position int
+	Item     string
+	Messages []pecan.Message
+	Readable bool
+	Grade    int
+	Judged   bool
+	Prev     int
+	Next     int
+}
+
+// Number is the position of the item being assessed, counting from one.
+func (p assessmentPage) Number() int {
+	return p.Position + 1
+}
+
+// Label is the name the assessor chose to be shown by, or who they are if they did not choose one.
+func (p assessmentPage) Label(assessor string) string {
+	if name, ok := p.Names[assessor]; ok {
+		return name
+	}
+	return assessor
+}
+
+// identify returns who the assessor of the request is and the name they chose to be shown by.
+// Logged in users are identified by their user ID so that nobody can judge as someone else.
+// When there is no authentication, each browser that starts assessing is a separate assessor.
+func (addon *AssessmentAddon) identify(c *gin.Context) (string, string, error) {
+	session := sessions.Default(c)
+	assessor, err := addon.api.UserID(c)
+	if err != nil {
+		return "", "", err
+	}
+	if len(assessor) > 0 {
+		return assessor, "", nil
+	}
+	assessor, _ = session.Get("assessment_assessor").(string)
+	name, _ := session.Get("assessment_name").(string)
+	return assessor, name, nil
+}
+
+// start begins assessing in a browser when there is no authentication, identifying the assessor by a
+// random ID and showing them by the name they posted.
+func (addon *AssessmentAddon) start(c *gin.Context) {
+	name := strings.TrimSpace(c.PostForm("assessor"))
+	if len(name) == 0 {
+		return
+	}
+	session := sessions.Default(c)
+	if assessor, _ := session.Get("assessment_assessor").(string); len(assessor) == 0 {
+		b := make([]byte, 8)
+		if _, err := rand.Read(b); err != nil {
+			panic(err)
+		}
+		session.Set("assessment_assessor", "session-"+hex.EncodeToString(b))
+	}
+	session.Set("assessment_name", name)
+	if err := session.Save(); err != nil {
+		panic(err)
+	}
+}
+
+// Handler shows assessors an overview of their progress, or the item at ?topic=<id>&item=<position> to judge.
+// Judgements are downloaded as qrels with ?action=qrels&key=<export_key>, optionally for a single
+// &assessor=<id>, and as recorded with ?action=judgements&key=<export_key>.
+func (addon *AssessmentAddon) Handler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		switch c.Query("action") {
+		case "qrels", "judgements":
+			addon.export(c)
+			return
+		}
+
+		assessor, name, err := addon.identify(c)
+		if err != nil {
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
+
+		if c.Request.Method == http.MethodPost {
+			switch c.PostForm("action") {
+			case "start":
+				if len(assessor) == 0 {
+					addon.start(c)
+				}
+			case "judge":
+				topic, ok := addon.topic(c.PostForm("topic"))
+				position, err := strconv.Atoi(c.PostForm("item"))
+				grade, gradeErr := strconv.Atoi(c.PostForm("grade"))
+				if len(assessor) == 0 || !ok || err != nil || position < 0 || position >= len(topic.Items) || gradeErr != nil || !addon.validGrade(grade) {
+					c.AbortWithStatus(http.StatusBadRequest)
+					return
+				}
+				addon.Lock()
+				addon.record(judgement{Assessor: assessor, Name: name, Topic: topic.Id, Item: topic.Items[position], Grade: grade})
+				next := addon.nextItem(topic, assessor, position)
+				addon.Unlock()
+				if next >= 0 {
+					c.Redirect(http.StatusFound, fmt.Sprintf("/addon/assessment?topic=%s&item=%d", url.QueryEscape(topic.Id), next))
+					return
+				}
+			}
+			c.Redirect(http.StatusFound, "/addon/assessment")
+			return
+		}
+
+		addon.Lock()
+		page := assessmentPage{Assessor: assessor, Names: make(map[string]string, len(addon.names)), Grades: addon.grades}
+		for a, n := range addon.names {
+			page.Names[a] = n
+		}
+		addon.Unlock()
+		if len(name) > 0 {
+			page.Names[assessor] = name
+		}
+		if len(assessor) == 0 {
+			addon.render(c, http.StatusOK, page)
+			return
+		}
+
+		topic, ok := addon.topic(c.Query("topic"))
+		if !ok || len(topic.Items) == 0 {
+			addon.Lock()
+			page.Progress = addon.progress()
+			page.Agreements = addon.agreement()
+			addon.Unlock()
+			addon.render(c, http.StatusOK, page)
+			return
+		}
+
+		addon.Lock()
+		position, err := strconv.Atoi(c.Query("item"))
+		if err != nil || position < 0 || position >= len(topic.Items) {
+			position = addon.nextItem(topic, assessor, len(topic.Items)-1)
+			if position < 0 {
+				position = 0
+			}
+		}
+		page.Topic = topic
+		page.Position = position
+		page.Item = topic.Items[position]
+		page.Grade, page.Judged = addon.judgements[topic.Id][page.Item][assessor]
+		addon.Unlock()
+		page.Prev = (position + len(topic.Items) - 1) % len(topic.Items)
+		page.Next = (position + 1) % len(topic.Items)
+
+		page.Messages, page.Readable, err = addon.context(c, page.Item)
+		code := http.StatusOK
+		if err == pecan.ErrMessageNotFound {
+			code, err = http.StatusNotFound, nil
+		} else if !page.Readable {
+			code = http.StatusForbidden
+		}
+		if err != nil {
+			panic(err)
+		}
+		addon.render(c, code, page)
+	}
+}
+
+// render renders the page with a status, which is 403 when the assessor cannot read the item.
+func (addon *AssessmentAddon) render(c *gin.Context, code int, page assessmentPage) {
+	c.Header("Content-Type", "text/html; charset=utf-8")
+	c.Status(code)
+	if err := addon.page.Execute(c.Writer, page); err != nil {
+		panic(err)
+	}
+}
+
+// export downloads the judgements, so long as the export key is configured and given.
+func (addon *AssessmentAddon) export(c *gin.Context) {
+	if len(addon.exportKey) == 0 || c.Query("key") != addon.exportKey {
+		c.AbortWithStatus(http.StatusForbidden)
+		return
+	}
+	addon.Lock()
+	defer addon.Unlock()
+	if c.Query("action") == "judgements" {
+		c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, "assessment.jsonl"))
+		c.File(addon.output.Name())
+		return
+	}
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, "qrels.txt"))
+	c.Data(http.StatusOK, "text/plain", addon.qrels(c.Query("assessor")))
+}
@@ -0,0 +1,107 @@
+package addon
+
+import (
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-contrib/sessions/cookie"
+	"github.com/gin-gonic/gin"
+	"github.com/ielab/pecan"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// headerUserAPI is a chat API whose users are logged in as the X-User header of their requests.
+type headerUserAPI struct {
+	*pecan.NoChatAPI
+}
+
+func (api headerUserAPI) UserID(c *gin.Context) (string, error) {
+	return c.GetHeader("X-User"), nil
+}
+
+// assessmentRouter serves an assessment addon with a single topic of two items.
+func assessmentRouter(t *testing.T, api pecan.ChatAPI) (*gin.Engine, *AssessmentAddon) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	dir := t.TempDir()
+	config := new(pecan.Config)
+	config.Assessment.Pool = filepath.Join(dir, "pool.json")
+	config.Assessment.Output = filepath.Join(dir, "assessment.jsonl")
+	if err := ioutil.WriteFile(config.Assessment.Pool, []byte(`{"topics":[{"id":"1","title":"one","items":["m1","m2"]}]}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	addon := NewAssessmentAddon()
+	addon.Initialise(nil, api, config)
+	t.Cleanup(func() {
+		addon.output.Close()
+	})
+
+	router := gin.New()
+	router.Use(sessions.Sessions("pecan", cookie.NewStore([]byte("secret"))))
+	router.GET("/addon/assessment", addon.Handler())
+	router.POST("/addon/assessment", addon.Handler())
+	return router, addon
+}
+
+// postAssessment posts the form as the user, with the cookies, and returns the response.
+func postAssessment(router *gin.Engine, user string, cookies []*http.Cookie, form url.Values) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/addon/assessment", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if len(user) > 0 {
+		r.Header.Set("X-User", user)
+	}
+	for _, cookie := range cookies {
+		r.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	return w
+}
+
+func TestAssessorIsLoggedInUser(t *testing.T) {
+	router, addon := assessmentRouter(t, headerUserAPI{pecan.NewNoChatAPI()})
+
+	// Naming someone else does not let a user judge as them.
+	postAssessment(router, "alice", nil, url.Values{"action": {"start"}, "assessor": {"bob"}})
+	w := postAssessment(router, "alice", nil, url.Values{"action": {"judge"}, "topic": {"1"}, "item": {"0"}, "grade": {"2"}, "assessor": {"bob"}})
+	if w.Code != http.StatusFound {
+		t.Fatalf("responded %d", w.Code)
+	}
+	if _, ok := addon.judgements["1"]["m1"]["bob"]; ok {
+		t.Error("judged as the assessor named in the form")
+	}
+	if grade, ok := addon.judgements["1"]["m1"]["alice"]; !ok || grade != 2 {
+		t.Errorf("judged %v, want alice to have judged 2", addon.judgements["1"]["m1"])
+	}
+}
+
+func TestAssessorWithoutAuthentication(t *testing.T) {
+	router, addon := assessmentRouter(t, pecan.NewNoChatAPI())
+
+	// Two browsers that choose the same name are still separate assessors.
+	for _, grade := range []string{"1", "2"} {
+		w := postAssessment(router, "", nil, url.Values{"action": {"start"}, "assessor": {"alice"}})
+		cookies := w.Result().Cookies()
+		w = postAssessment(router, "", cookies, url.Values{"action": {"judge"}, "topic": {"1"}, "item": {"0"}, "grade": {grade}})
+		if w.Code != http.StatusFound {
+			t.Fatalf("responded %d", w.Code)
+		}
+	}
+	if len(addon.judgements["1"]["m1"]) != 2 {
+		t.Errorf("judged %v, want two assessors", addon.judgements["1"]["m1"])
+	}
+	for assessor := range addon.judgements["1"]["m1"] {
+		if addon.names[assessor] != "alice" {
+			t.Errorf("assessor %s is shown as %q, want alice", assessor, addon.names[assessor])
+		}
+	}
+
+	// Judging without starting is rejected.
+	if w := postAssessment(router, "", nil, url.Values{"action": {"judge"}, "topic": {"1"}, "item": {"0"}, "grade": {"1"}}); w.Code != http.StatusBadRequest {
+		t.Errorf("responded %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
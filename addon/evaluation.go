@@ -1,66 +1,63 @@
 package addon
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"github.com/gin-gonic/gin"
-	"github.com/hscells/trecresults"
 	"github.com/ielab/pecan"
+	"github.com/ielab/pecan/eval"
 	"github.com/olivere/elastic/v7"
 	"net/http"
-	"strconv"
-	"time"
+	"strings"
 )
 
 type EvaluationAddon struct {
-	es    *elastic.Client
-	api   pecan.ChatAPI
-	index string
+	es        *elastic.Client
+	api       pecan.ChatAPI
+	index     string
+	pipelines map[string]pecan.Pipeline
 }
 
+// EvaluationRequest retrieves a run for a single topic with its query, or, when Topics is given,
+// a run for every topic in Topics with each of the Pipelines.
 type EvaluationRequest struct {
-	Bounder    string `json:"bounder,omitempty"`
-	Aggregator string `json:"aggregator,omitempty"`
-	Scorer     string `json:"scorer,omitempty"`
+	pecan.Pipeline
+	// RunName is the name of the run of a single topic.
+	RunName string `json:"run_name,omitempty"`
 
 	Topic string `json:"topic"`
+	// Topics is the contents of a topics file, in the TREC format or with one JSON object per line.
+	Topics string `json:"topics,omitempty"`
+	// Pipelines are the pipelines to run the topics through, keyed by the name of their run.
+	// When there are none, the pipelines in the config are used.
+	Pipelines map[string]pecan.Pipeline `json:"pipelines,omitempty"`
+
+	// Depth is the number of conversations to retrieve for the topic.
+	Depth int `json:"depth,omitempty"`
+	// Granularity is whether runs rank conversations, messages, or only the messages that matched the query.
+	Granularity string `json:"granularity,omitempty"`
+	// Qrels are judgements of messages or conversations in the TREC qrels format.
+	// When they are given, the run is scored against them rather than returned.
+	Qrels string `json:"qrels,omitempty"`
+	// Cutoff is the rank that measures are cut off at when scoring the run.
+	Cutoff int `json:"cutoff,omitempty"`
+	// Compare is a measure to test the significance of the differences between the runs of topics on,
+	// with p-values corrected by Correction.
+	Compare    string `json:"compare,omitempty"`
+	Correction string `json:"correction,omitempty"`
 	pecan.SearchRequest
 }
 
-func (addon *EvaluationAddon) messagesResults(request EvaluationRequest) (trecresults.ResultList, error) {
-	exec := pecan.NewTaskExecutor(addon.api, addon.es).
-		SetBoundsFunc(pecan.MustMapBoundFunc(request.Bounder)).
-		SetAggregateFunc(pecan.MustMapAggregateFunc(request.Aggregator)).
-		SetScoreFunc(pecan.MustMapScoreFunc(request.Scorer))
-
-	conversations, err := exec.GetConversations(context.Background(), addon.api, request.SearchRequest)
-	if err != nil {
-		return nil, err
-	}
-
-	var numResults int
-	for _, conversation := range conversations {
-		numResults += len(conversation.Messages)
-	}
-
-	results := make(trecresults.ResultList, numResults)
-
-	var i int64
-	for cId, conversation := range conversations {
-		cIdStr := strconv.Itoa(cId)
-		for _, message := range conversation.Messages {
-			results[i] = &trecresults.Result{
-				Topic:     request.Topic,
-				Iteration: "0",
-				DocId:     cIdStr + "_" + message.Id,
-				Rank:      i,
-				Score:     conversation.Score,
-				RunName:   "",
-			}
-			i++
-		}
-	}
-
-	return results, nil
+// BatchEvaluationResponse contains the TREC run of each pipeline, and its measures when qrels were given.
+type BatchEvaluationResponse struct {
+	Runs map[string]string `json:"runs"`
+	// Sidecars list the messages in the conversations of each run, when runs are of conversations.
+	Sidecars map[string]string       `json:"sidecars,omitempty"`
+	Results  map[string]eval.Results `json:"results,omitempty"`
+	// Comparison and ComparisonMarkdown are the significance tests between the runs, when they were requested.
+	Comparison         *eval.ComparisonTable `json:"comparison,omitempty"`
+	ComparisonMarkdown string                `json:"comparison_markdown,omitempty"`
 }
 
 func NewEvaluationAddon() *EvaluationAddon {
@@ -71,36 +68,161 @@ func (addon *EvaluationAddon) Initialise(es *elastic.Client, api pecan.ChatAPI,
 	addon.es = es
 	addon.api = api
 	addon.index = config.Elasticsearch.Index
+	addon.pipelines = config.Pipelines
+}
+
+// evaluate runs the topics through the pipelines, and writes a run for each of them, scored when there are qrels.
+// pecan.ErrChannelForbidden is returned when a topic is restricted to a channel that the user cannot read.
+func (addon *EvaluationAddon) evaluate(ctx context.Context, request EvaluationRequest, topics []eval.Topic, pipelines map[string]pecan.Pipeline) (BatchEvaluationResponse, error) {
+	var response BatchEvaluationResponse
+	if len(request.Granularity) == 0 {
+		request.Granularity = eval.DefaultGranularity
+	}
+	var qrels eval.Qrels
+	if len(request.Qrels) > 0 {
+		var err error
+		qrels, err = eval.ParseQrels(strings.NewReader(request.Qrels))
+		if err != nil {
+			return response, err
+		}
+		// Only the topics that were run are scored.
+		scored := make(eval.Qrels)
+		for _, topic := range topics {
+			if judged, ok := qrels[topic.Id]; ok {
+				scored[topic.Id] = judged
+			}
+		}
+		qrels = scored
+	}
+
+	depth := request.Depth
+	if depth <= 0 {
+		depth = pecan.SearchSize
+	}
+	request.Index = addon.index
+	// The pipelines share the request, so its session is loaded before they run rather than by each of them.
+	if _, _, err := addon.api.ReadableChannels(request.Context); err != nil {
+		return response, err
+	}
+	exec := pecan.NewTaskExecutor(addon.api, addon.es)
+	retrieved, err := eval.RetrievePipelines(ctx, exec, addon.api, pipelines, topics, request.SearchRequest, depth)
+	if err != nil {
+		return response, err
+	}
+
+	response.Runs = make(map[string]string)
+	if request.Granularity == eval.ConversationGranularity {
+		response.Sidecars = make(map[string]string)
+	}
+	if qrels != nil {
+		response.Results = make(map[string]eval.Results)
+	}
+	for name, conversations := range retrieved {
+		var buf bytes.Buffer
+		if err := eval.WriteRun(&buf, name, request.Granularity, topics, conversations); err != nil {
+			return response, err
+		}
+		response.Runs[name] = buf.String()
+		if response.Sidecars != nil {
+			buf.Reset()
+			if err := eval.WriteSidecar(&buf, topics, conversations); err != nil {
+				return response, err
+			}
+			response.Sidecars[name] = buf.String()
+		}
+		if qrels != nil {
+			response.Results[name] = eval.Evaluate(qrels, eval.ConversationRun(name, conversations), request.Cutoff)
+		}
+	}
+
+	if len(request.Compare) > 0 && len(response.Results) > 1 {
+		table, err := eval.Compare(response.Results, request.Compare, request.Correction, eval.DefaultTrials)
+		if err != nil {
+			return response, err
+		}
+		var buf bytes.Buffer
+		if err := table.WriteMarkdown(&buf); err != nil {
+			return response, err
+		}
+		response.Comparison = &table
+		response.ComparisonMarkdown = buf.String()
+	}
+	return response, nil
 }
 
 func (addon *EvaluationAddon) Handler() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		var request EvaluationRequest
+		if err := c.BindJSON(&request); err != nil {
+			return
+		}
+		// Runs only contain the channels that the user can read.
+		request.Context = c
+		err := pecan.CheckChannelFilter(addon.api, request.SearchRequest)
+		if errors.Is(err, pecan.ErrChannelForbidden) {
+			c.JSON(http.StatusForbidden, pecan.ErrorResponse{Error: err.Error()})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, pecan.ErrorResponse{Error: err.Error()})
+			return
+		}
+		switch request.Granularity {
+		case "", eval.ConversationGranularity, eval.MessageGranularity, eval.HitGranularity:
+		default:
+			c.JSON(http.StatusBadRequest, pecan.ErrorResponse{Error: eval.ErrUnknownGranularity.Error()})
+			return
+		}
 
-		if err := c.BindJSON(&request); err == nil && len(request.Query) > 0 {
-			from := "2010-01-01"
-			to := time.Now().Format("2006-01-02")
-			request.From, err = time.Parse(pecan.DateFormat, from)
+		if len(request.Topics) > 0 {
+			topics, err := eval.ParseTopics(strings.NewReader(request.Topics))
 			if err != nil {
-				panic(err)
+				c.JSON(http.StatusBadRequest, pecan.ErrorResponse{Error: err.Error()})
+				return
 			}
-			request.To, err = time.Parse(pecan.DateFormat, to)
-			if err != nil {
-				panic(err)
+			pipelines := request.Pipelines
+			if len(pipelines) == 0 {
+				pipelines = addon.pipelines
 			}
-			request.Index = addon.index
-			results, err := addon.messagesResults(request)
-			if err != nil {
-				panic(err)
+			if len(pipelines) == 0 {
+				pipelines = map[string]pecan.Pipeline{eval.DefaultRunName: request.Pipeline}
+			}
+			response, err := addon.evaluate(c.Request.Context(), request, topics, pipelines)
+			if errors.Is(err, pecan.ErrChannelForbidden) {
+				c.JSON(http.StatusForbidden, pecan.ErrorResponse{Error: err.Error()})
+				return
 			}
-
-			b, err := results.Marshal()
 			if err != nil {
-				panic(err)
+				c.JSON(http.StatusInternalServerError, pecan.ErrorResponse{Error: err.Error()})
+				return
 			}
-
-			c.Data(http.StatusOK, "text/plain", b)
+			c.JSON(http.StatusOK, response)
+			return
 		}
 
+		if len(request.Query) == 0 {
+			c.JSON(http.StatusBadRequest, pecan.ErrorResponse{Error: "a query or topics are required"})
+			return
+		}
+		runName := request.RunName
+		if len(runName) == 0 {
+			runName = eval.DefaultRunName
+		}
+		topics := []eval.Topic{{Id: request.Topic, Query: request.Query}}
+		response, err := addon.evaluate(c.Request.Context(), request, topics, map[string]pecan.Pipeline{runName: request.Pipeline})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, pecan.ErrorResponse{Error: err.Error()})
+			return
+		}
+		if response.Results != nil {
+			c.JSON(http.StatusOK, response.Results[runName])
+			return
+		}
+		// A run of conversations cannot be related back to messages without its sidecar.
+		if response.Sidecars != nil {
+			c.JSON(http.StatusOK, response)
+			return
+		}
+		c.Data(http.StatusOK, "text/plain", []byte(response.Runs[runName]))
 	}
 }
@@ -0,0 +1,588 @@
+package addon
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/ielab/pecan"
+	"github.com/olivere/elastic/v7"
+	"hash/fnv"
+	"math"
+	mathrand "math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Methods of interleaving the rankings of two pipelines.
+const (
+	// TeamDraft alternates between the pipelines like captains picking teams,
+	// with a coin flip deciding which picks first whenever they have picked equally often.
+	TeamDraft = "team-draft"
+	// Probabilistic picks a pipeline at random for each rank, and then samples one of its
+	// conversations with a probability that decreases with their rank.
+	Probabilistic = "probabilistic"
+)
+
+// probabilisticTau controls how strongly probabilistic interleaving prefers highly ranked conversations.
+const probabilisticTau = 3
+
+// InterleavingImpressionTTL is how long after an impression is shown that its later pages can be retrieved
+// and clicks on it are credited. Older impressions only count towards the outcome of their pair.
+const InterleavingImpressionTTL = 24 * time.Hour
+
+// Teams that the conversations of an interleaved ranking are credited to.
+const (
+	teamA = "a"
+	teamB = "b"
+)
+
+// impressionSeparator joins the id of an impression to the number of a page of it. It cannot occur in either.
+const impressionSeparator = "."
+
+// impressionCursor is the cursor of page n of an impression, so that later pages and clicks are attributed
+// to the impression they came from, however many searches a user has open at once.
+func impressionCursor(id string, n int) string {
+	return id + impressionSeparator + strconv.Itoa(n)
+}
+
+// splitImpressionCursor separates the id of an impression from the page number of a cursor made by impressionCursor.
+func splitImpressionCursor(cursor string) (id string, n int, ok bool) {
+	i := strings.Index(cursor, impressionSeparator)
+	if i < 0 {
+		return "", 0, false
+	}
+	n, err := strconv.Atoi(cursor[i+len(impressionSeparator):])
+	if err != nil || n < 0 {
+		return "", 0, false
+	}
+	return cursor[:i], n, true
+}
+
+// errImpressionExpired is returned for a page of an impression that has expired, or was never shown.
+var errImpressionExpired = fmt.Errorf("interleaving: %w", pecan.ErrCursorExpired)
+
+// interleavedImpression is an interleaved ranking that was shown, and the clicks on it.
+type interleavedImpression struct {
+	pair    int
+	method  string
+	shown   time.Time
+	pages   map[int]bool
+	teams   map[string]string
+	clicked map[string]bool
+	clicks  map[string]int
+}
+
+func newInterleavedImpression(pair int, method string, shown time.Time) *interleavedImpression {
+	return &interleavedImpression{
+		pair:    pair,
+		method:  method,
+		shown:   shown,
+		pages:   make(map[int]bool),
+		teams:   make(map[string]string),
+		clicked: make(map[string]bool),
+		clicks:  make(map[string]int),
+	}
+}
+
+// interleavingRecord is a line of the output of the interleaving addon: either an impression, with the team
+// of each conversation of its first page in rank order, a later page of an impression, or a click on a
+// conversation of an impression.
+type interleavingRecord struct {
+	Type         string    `json:"type"`
+	Time         time.Time `json:"time"`
+	Impression   string    `json:"impression"`
+	Page         int       `json:"page,omitempty"`
+	Method       string    `json:"method,omitempty"`
+	A            string    `json:"a,omitempty"`
+	B            string    `json:"b,omitempty"`
+	Query        string    `json:"query,omitempty"`
+	Results      []string  `json:"results,omitempty"`
+	Teams        []string  `json:"teams,omitempty"`
+	Conversation string    `json:"conversation,omitempty"`
+	Team         string    `json:"team,omitempty"`
+}
+
+// InterleavingOutcome counts how often each pipeline of a pair won an impression by receiving more clicks.
+// Preference is the proportion of impressions with clicks that A won, counting ties as half, less a half,
+// so that it is positive when users prefer A and negative when they prefer B.
+type InterleavingOutcome struct {
+	A           string  `json:"a"`
+	B           string  `json:"b"`
+	Impressions int     `json:"impressions"`
+	Clicked     int     `json:"clicked"`
+	WinsA       int     `json:"wins_a"`
+	WinsB       int     `json:"wins_b"`
+	Ties        int     `json:"ties"`
+	Preference  float64 `json:"preference"`
+}
+
+// InterleavingAddon evaluates pairs of pipelines online by interleaving their rankings on every page of search results.
+// Clicks on conversations, as recorded by the logging addon, are credited to the pipeline that contributed the conversation.
+// The impression that a page or click belongs to is carried in the cursors of its results. Impressions are
+// kept for InterleavingImpressionTTL, after which only their outcome is.
+type InterleavingAddon struct {
+	sync.Mutex
+	exec        *pecan.TaskExecutor
+	method      string
+	pipelines   map[string]pecan.Pipeline
+	pairs       [][2]string
+	impressions map[string]*interleavedImpression
+	// shown are the ids of the impressions in the order they were shown, so that they expire in that order.
+	shown []string
+	// settled are the outcomes of each pair over the impressions that have expired.
+	settled []InterleavingOutcome
+	output  *os.File
+}
+
+func NewInterleavingAddon() *InterleavingAddon {
+	return &InterleavingAddon{
+		impressions: make(map[string]*interleavedImpression),
+	}
+}
+
+func (addon *InterleavingAddon) Initialise(es *elastic.Client, api pecan.ChatAPI, config *pecan.Config) {
+	addon.exec = pecan.NewTaskExecutor(api, es)
+	addon.pipelines = config.Pipelines
+	addon.pairs = config.Interleaving.Pairs
+	for _, pair := range addon.pairs {
+		for _, name := range pair {
+			if _, ok := addon.pipelines[name]; !ok {
+				panic(fmt.Sprintf("interleaving: no pipeline named %q in config", name))
+			}
+		}
+	}
+
+	addon.settled = make([]InterleavingOutcome, len(addon.pairs))
+	addon.method = config.Interleaving.Method
+	if len(addon.method) == 0 {
+		addon.method = TeamDraft
+	}
+	if addon.method != TeamDraft && addon.method != Probabilistic {
+		panic(fmt.Sprintf("interleaving: unknown method %q", addon.method))
+	}
+
+	var logging bool
+	for _, name := range config.Addons {
+		logging = logging || name == "logging"
+	}
+	if !logging {
+		panic("interleaving: the logging addon must be enabled to record clicks")
+	}
+	Addons["logging"].(*LoggingAddon).Subscribe(addon.observe)
+
+	output := config.Interleaving.Output
+	if len(output) == 0 {
+		output = "interleaving.jsonl"
+	}
+	err := addon.replay(output)
+	if err != nil {
+		panic(err)
+	}
+	addon.output, err = os.OpenFile(output, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// pairIndex is the position of a pair of pipelines in the config, or -1 if it is no longer configured.
+func (addon *InterleavingAddon) pairIndex(a, b string) int {
+	for i, pair := range addon.pairs {
+		if pair[0] == a && pair[1] == b {
+			return i
+		}
+	}
+	return -1
+}
+
+// replay restores the impressions and clicks recorded in a previous run of the addon.
+func (addon *InterleavingAddon) replay(path string) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var record interleavingRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return err
+		}
+		switch record.Type {
+		case "impression":
+			addon.expire(record.Time)
+			imp := newInterleavedImpression(addon.pairIndex(record.A, record.B), record.Method, record.Time)
+			imp.show(record.Page, record.Results, record.Teams)
+			addon.impressions[record.Impression] = imp
+			addon.shown = append(addon.shown, record.Impression)
+		case "page":
+			if imp, ok := addon.impressions[record.Impression]; ok {
+				imp.show(record.Page, record.Results, record.Teams)
+			}
+		case "click":
+			if imp, ok := addon.impressions[record.Impression]; ok {
+				imp.clicked[record.Conversation] = true
+				imp.clicks[record.Team]++
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	addon.expire(time.Now())
+	return nil
+}
+
+// show adds a page of conversations, and the teams they were credited to, to the impression.
+func (imp *interleavedImpression) show(page int, results, teams []string) {
+	imp.pages[page] = true
+	for i, id := range results {
+		imp.teams[id] = teams[i]
+	}
+}
+
+// expire forgets the impressions shown InterleavingImpressionTTL before now, keeping only their outcome.
+// The caller must hold the lock.
+func (addon *InterleavingAddon) expire(now time.Time) {
+	for len(addon.shown) > 0 {
+		imp, ok := addon.impressions[addon.shown[0]]
+		if ok && now.Sub(imp.shown) < InterleavingImpressionTTL {
+			return
+		}
+		if ok {
+			if imp.pair >= 0 {
+				imp.tally(&addon.settled[imp.pair])
+			}
+			delete(addon.impressions, addon.shown[0])
+		}
+		addon.shown = addon.shown[1:]
+	}
+}
+
+// record appends a record to the output. The caller must hold the lock.
+func (addon *InterleavingAddon) record(record interleavingRecord) {
+	record.Time = time.Now()
+	b, err := json.Marshal(record)
+	if err != nil {
+		panic(err)
+	}
+	_, err = addon.output.Write(append(b, '\n'))
+	if err != nil {
+		panic(err)
+	}
+}
+
+// teamDraft interleaves two rankings using team-draft interleaving.
+func teamDraft(rng *mathrand.Rand, a, b []pecan.Conversation, size int) ([]pecan.Conversation, []string) {
+	var (
+		interleaved []pecan.Conversation
+		teams       []string
+		seen        = make(map[string]bool)
+		ia, ib      int
+		picksA      int
+		picksB      int
+	)
+	for len(interleaved) < size {
+		for ia < len(a) && seen[a[ia].ID().String()] {
+			ia++
+		}
+		for ib < len(b) && seen[b[ib].ID().String()] {
+			ib++
+		}
+		if ia >= len(a) && ib >= len(b) {
+			break
+		}
+		pickA := picksA < picksB || (picksA == picksB && rng.Intn(2) == 0)
+		if ia >= len(a) {
+			pickA = false
+		} else if ib >= len(b) {
+			pickA = true
+		}
+		if pickA {
+			seen[a[ia].ID().String()] = true
+			interleaved = append(interleaved, a[ia])
+			teams = append(teams, teamA)
+			picksA++
+		} else {
+			seen[b[ib].ID().String()] = true
+			interleaved = append(interleaved, b[ib])
+			teams = append(teams, teamB)
+			picksB++
+		}
+	}
+	return interleaved, teams
+}
+
+// sampleByRank picks a conversation of a ranking that has not been seen, with a probability proportional to 1/rank^tau.
+func sampleByRank(rng *mathrand.Rand, ranking []pecan.Conversation, seen map[string]bool) (pecan.Conversation, bool) {
+	var total float64
+	weights := make([]float64, len(ranking))
+	for i, c := range ranking {
+		if !seen[c.ID().String()] {
+			weights[i] = 1 / math.Pow(float64(i+1), probabilisticTau)
+			total += weights[i]
+		}
+	}
+	if total == 0 {
+		return pecan.Conversation{}, false
+	}
+	r := rng.Float64() * total
+	for i, w := range weights {
+		if w == 0 {
+			continue
+		}
+		r -= w
+		if r <= 0 {
+			return ranking[i], true
+		}
+	}
+	// Rounding may leave a little of r, in which case the last unseen conversation is picked.
+	for i := len(ranking) - 1; i >= 0; i-- {
+		if weights[i] > 0 {
+			return ranking[i], true
+		}
+	}
+	return pecan.Conversation{}, false
+}
+
+// probabilistic interleaves two rankings using probabilistic interleaving.
+func probabilistic(rng *mathrand.Rand, a, b []pecan.Conversation, size int) ([]pecan.Conversation, []string) {
+	var (
+		interleaved []pecan.Conversation
+		teams       []string
+		seen        = make(map[string]bool)
+	)
+	for len(interleaved) < size {
+		first, second, team, other := a, b, teamA, teamB
+		if rng.Intn(2) == 0 {
+			first, second, team, other = b, a, teamB, teamA
+		}
+		c, ok := sampleByRank(rng, first, seen)
+		if !ok {
+			c, ok = sampleByRank(rng, second, seen)
+			team = other
+		}
+		if !ok {
+			break
+		}
+		seen[c.ID().String()] = true
+		interleaved = append(interleaved, c)
+		teams = append(teams, team)
+	}
+	return interleaved, teams
+}
+
+// interleavePages interleaves two rankings into pages of size conversations, up to and including page n,
+// using the random choices of the seed so that the same pages are made every time.
+// It reports whether there are any conversations after page n.
+func interleavePages(method string, seed int64, a, b []pecan.Conversation, size, n int) ([]pecan.Conversation, []string, bool) {
+	rng := mathrand.New(mathrand.NewSource(seed))
+	var interleaved []pecan.Conversation
+	var teams []string
+	switch method {
+	case Probabilistic:
+		interleaved, teams = probabilistic(rng, a, b, (n+1)*size+1)
+	default:
+		interleaved, teams = teamDraft(rng, a, b, (n+1)*size+1)
+	}
+	more := len(interleaved) > (n+1)*size
+	start, end := n*size, (n+1)*size
+	if start > len(interleaved) {
+		start = len(interleaved)
+	}
+	if end > len(interleaved) {
+		end = len(interleaved)
+	}
+	return interleaved[start:end], teams[start:end], more
+}
+
+// impressionSeed is the seed of the random choices made when interleaving the pages of an impression.
+func impressionSeed(id string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte(id))
+	return int64(h.Sum64())
+}
+
+// interleavedPage retrieves page n of an impression. Both pipelines of its pair retrieve their rankings
+// to the depth of the page, which are interleaved from the first page with the same random choices every time,
+// so that each page continues from the conversations that both pipelines have left.
+// A page that has not been shown before is recorded.
+func (addon *InterleavingAddon) interleavedPage(ctx context.Context, api pecan.ChatAPI, request pecan.SearchRequest, id string, imp *interleavedImpression, n int) (pecan.ConversationPage, error) {
+	pair := addon.pairs[imp.pair]
+	size := request.Size
+	if size <= 0 {
+		size = pecan.ConversationsPerPage
+	}
+	depth := (n+1)*size + 1
+	a, err := addon.exec.WithPipeline(addon.pipelines[pair[0]]).GetTopConversations(ctx, api, request, depth)
+	if err != nil {
+		return pecan.ConversationPage{}, err
+	}
+	b, err := addon.exec.WithPipeline(addon.pipelines[pair[1]]).GetTopConversations(ctx, api, request, depth)
+	if err != nil {
+		return pecan.ConversationPage{}, err
+	}
+
+	conversations, teams, more := interleavePages(imp.method, impressionSeed(id), a, b, size, n)
+	page := pecan.ConversationPage{
+		Conversations: conversations,
+		Start:         n * size,
+		Cursor:        impressionCursor(id, n),
+	}
+	if more {
+		page.Next = impressionCursor(id, n+1)
+	}
+	if n > 0 {
+		page.Prev = impressionCursor(id, n-1)
+	}
+
+	results := make([]string, len(conversations))
+	for i, conversation := range conversations {
+		results[i] = conversation.ID().String()
+	}
+	record := interleavingRecord{Type: "page", Impression: id, Page: n, Results: results, Teams: teams}
+	addon.Lock()
+	defer addon.Unlock()
+	if n == 0 {
+		record.Type, record.Method, record.A, record.B, record.Query = "impression", imp.method, pair[0], pair[1], request.Query
+		addon.expire(imp.shown)
+		addon.impressions[id] = imp
+		addon.shown = append(addon.shown, id)
+	}
+	if !imp.pages[n] {
+		imp.show(n, results, teams)
+		addon.record(record)
+	}
+	return page, nil
+}
+
+// interleave shows the first page of the interleaved rankings of a request by a random pair of pipelines,
+// as a new impression.
+func (addon *InterleavingAddon) interleave() pecan.PageFunc {
+	return func(ctx context.Context, api pecan.ChatAPI, request pecan.SearchRequest) (pecan.ConversationPage, error) {
+		id := make([]byte, 16)
+		if _, err := rand.Read(id); err != nil {
+			return pecan.ConversationPage{}, err
+		}
+		imp := newInterleavedImpression(mathrand.Intn(len(addon.pairs)), addon.method, time.Now())
+		return addon.interleavedPage(ctx, api, request, hex.EncodeToString(id), imp, 0)
+	}
+}
+
+// continuation shows a later page of an impression, or returns errImpressionExpired when it has expired.
+func (addon *InterleavingAddon) continuation(id string, n int) pecan.PageFunc {
+	return func(ctx context.Context, api pecan.ChatAPI, request pecan.SearchRequest) (pecan.ConversationPage, error) {
+		addon.Lock()
+		imp, ok := addon.impressions[id]
+		addon.Unlock()
+		if !ok || imp.pair < 0 || !imp.pages[0] {
+			return pecan.ConversationPage{}, errImpressionExpired
+		}
+		return addon.interleavedPage(ctx, api, request, id, imp, n)
+	}
+}
+
+// observe credits clicks on the conversations of an interleaved ranking to the pipeline that contributed them.
+// Each conversation is credited at most once per impression.
+func (addon *InterleavingAddon) observe(events []LogEvent) {
+	addon.Lock()
+	defer addon.Unlock()
+	for _, event := range events {
+		if event.Type != "click" || event.Path != "/search" || len(event.Conversation) == 0 {
+			continue
+		}
+		id, _, ok := splitImpressionCursor(event.Cursor)
+		if !ok {
+			continue
+		}
+		imp, ok := addon.impressions[id]
+		if !ok || imp.clicked[event.Conversation] {
+			continue
+		}
+		team, ok := imp.teams[event.Conversation]
+		if !ok {
+			continue
+		}
+		imp.clicked[event.Conversation] = true
+		imp.clicks[team]++
+		addon.record(interleavingRecord{Type: "click", Impression: id, Conversation: event.Conversation, Team: team})
+	}
+}
+
+// Middleware interleaves the first page of searches, and later pages, and exports, of an interleaved search.
+func (addon *InterleavingAddon) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if len(addon.pairs) == 0 || c.Request.URL.Path != "/search" || c.Request.Method != http.MethodGet {
+			c.Next()
+			return
+		}
+		query := c.Request.URL.Query()
+		cursor := query.Get("cursor")
+		if id, n, ok := splitImpressionCursor(cursor); ok {
+			c.Set(pecan.PageFuncKey, addon.continuation(id, n))
+		} else if len(cursor) == 0 && len(query.Get("export")) == 0 {
+			c.Set(pecan.PageFuncKey, addon.interleave())
+		}
+		c.Next()
+	}
+}
+
+// tally counts the impression towards the outcome of its pair.
+func (imp *interleavedImpression) tally(o *InterleavingOutcome) {
+	o.Impressions++
+	a, b := imp.clicks[teamA], imp.clicks[teamB]
+	if a+b == 0 {
+		return
+	}
+	o.Clicked++
+	switch {
+	case a > b:
+		o.WinsA++
+	case b > a:
+		o.WinsB++
+	default:
+		o.Ties++
+	}
+}
+
+// report counts the wins, losses, and ties of each pair of pipelines. The caller must hold the lock.
+func (addon *InterleavingAddon) report() []InterleavingOutcome {
+	outcomes := make([]InterleavingOutcome, len(addon.pairs))
+	copy(outcomes, addon.settled)
+	for i, pair := range addon.pairs {
+		outcomes[i].A = pair[0]
+		outcomes[i].B = pair[1]
+	}
+	for _, imp := range addon.impressions {
+		if imp.pair >= 0 {
+			imp.tally(&outcomes[imp.pair])
+		}
+	}
+	for i := range outcomes {
+		if o := &outcomes[i]; o.Clicked > 0 {
+			o.Preference = (float64(o.WinsA)+float64(o.Ties)/2)/float64(o.Clicked) - 0.5
+		}
+	}
+	return outcomes
+}
+
+// Handler reports the outcome of the interleaving experiment for each pair of pipelines.
+func (addon *InterleavingAddon) Handler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		addon.Lock()
+		defer addon.Unlock()
+		c.JSON(http.StatusOK, addon.report())
+	}
+}
@@ -0,0 +1,97 @@
+package addon
+
+import (
+	"github.com/ielab/pecan"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// ranking is a ranking of made up conversations, one for each timestamp.
+func ranking(timestamps ...int) []pecan.Conversation {
+	conversations := make([]pecan.Conversation, len(timestamps))
+	for i, ts := range timestamps {
+		conversations[i].Messages = []pecan.Message{{Channel: "C1", Timestamp: strconv.Itoa(ts)}}
+	}
+	return conversations
+}
+
+func TestInterleavePages(t *testing.T) {
+	a := ranking(1, 2, 3, 4, 5, 6, 7)
+	b := ranking(2, 8, 1, 9, 10)
+	// Between them, the rankings have ten conversations.
+	const all, size = 10, 3
+
+	for _, method := range []string{TeamDraft, Probabilistic} {
+		t.Run(method, func(t *testing.T) {
+			whole, wholeTeams, _ := interleavePages(method, 42, a, b, all, 0)
+			if len(whole) != all {
+				t.Fatalf("interleaved %d conversations, want %d", len(whole), all)
+			}
+
+			// Each page continues from where the one before it left off, without repeating conversations.
+			var paged []pecan.Conversation
+			var pagedTeams []string
+			for n := 0; ; n++ {
+				conversations, teams, more := interleavePages(method, 42, a, b, size, n)
+				again, _, _ := interleavePages(method, 42, a, b, size, n)
+				if !reflect.DeepEqual(conversations, again) {
+					t.Fatalf("page %d changed when it was made again", n)
+				}
+				paged = append(paged, conversations...)
+				pagedTeams = append(pagedTeams, teams...)
+				if !more {
+					break
+				}
+			}
+			if !reflect.DeepEqual(paged, whole) || !reflect.DeepEqual(pagedTeams, wholeTeams) {
+				t.Errorf("paged %v, want %v", paged, whole)
+			}
+		})
+	}
+}
+
+func TestImpressionCursor(t *testing.T) {
+	id, n, ok := splitImpressionCursor(impressionCursor("abc", 3))
+	if !ok || id != "abc" || n != 3 {
+		t.Errorf("split %q, %d, %v", id, n, ok)
+	}
+	for _, cursor := range []string{"", "eyJjIjp7fX0", "abc.", "abc.x", "abc.-1"} {
+		if _, _, ok := splitImpressionCursor(cursor); ok {
+			t.Errorf("split %q", cursor)
+		}
+	}
+}
+
+func TestImpressionsExpire(t *testing.T) {
+	addon := NewInterleavingAddon()
+	addon.pairs = [][2]string{{"x", "y"}}
+	addon.settled = make([]InterleavingOutcome, 1)
+
+	start := time.Date(2021, 3, 9, 0, 0, 0, 0, time.UTC)
+	for i, winner := range []string{teamA, teamB, teamA} {
+		imp := newInterleavedImpression(0, TeamDraft, start.Add(time.Duration(i)*time.Hour))
+		imp.clicks[winner]++
+		id := strconv.Itoa(i)
+		addon.impressions[id] = imp
+		addon.shown = append(addon.shown, id)
+	}
+
+	wins := 2.0
+	want := []InterleavingOutcome{{A: "x", B: "y", Impressions: 3, Clicked: 3, WinsA: 2, WinsB: 1, Preference: wins/3 - 0.5}}
+	addon.expire(start.Add(InterleavingImpressionTTL + time.Hour))
+	if len(addon.impressions) != 1 || len(addon.shown) != 1 {
+		t.Errorf("kept %d impressions, want the one shown within the TTL", len(addon.impressions))
+	}
+	if got := addon.report(); !reflect.DeepEqual(got, want) {
+		t.Errorf("reported %+v, want %+v", got, want)
+	}
+	addon.expire(start.Add(10 * InterleavingImpressionTTL))
+	if len(addon.impressions) != 0 || len(addon.shown) != 0 {
+		t.Errorf("kept %d impressions, want none", len(addon.impressions))
+	}
+	if got := addon.report(); !reflect.DeepEqual(got, want) {
+		t.Errorf("reported %+v, want %+v", got, want)
+	}
+}
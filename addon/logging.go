@@ -0,0 +1,307 @@
+package addon
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	_ "embed"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	"github.com/ielab/pecan"
+	"github.com/olivere/elastic/v7"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+//go:embed logging.js
+var loggingScript []byte
+
+// DefaultLogMaxSize is the size in bytes a log file may grow to before it is rotated.
+const DefaultLogMaxSize = 64 << 20
+
+// MaxLogRequestSize is the size in bytes of the largest request of events that is recorded, which is far larger
+// than the beacons that the logging script sends.
+const MaxLogRequestSize = 64 << 10
+
+// MaxLogRequestEvents is the most events that are recorded from a single request.
+const MaxLogRequestEvents = 32
+
+// LogLabelsKey is the key of a map[string]string in the gin context whose entries are added to every
+// logged event of the request, allowing other addons to annotate the events they are responsible for.
+const LogLabelsKey = "pecan.log.labels"
+
+// addLogLabels adds labels to those of the events logged for a request.
+func addLogLabels(c *gin.Context, labels map[string]string) {
+	merged := make(map[string]string)
+	for k, v := range c.GetStringMapString(LogLabelsKey) {
+		merged[k] = v
+	}
+	for k, v := range labels {
+		merged[k] = v
+	}
+	c.Set(LogLabelsKey, merged)
+}
+
+// LoggedResult is a conversation shown on a results page.
+type LoggedResult struct {
+	Conversation string `json:"conversation"`
+	Rank         int    `json:"rank"`
+}
+
+// LogEvent is a query or interaction recorded by the logging addon.
+// Events are sent by the browser; the time, session, and user are added by the server.
+type LogEvent struct {
+	Type         string            `json:"type"`
+	Path         string            `json:"path,omitempty"`
+	Query        string            `json:"query,omitempty"`
+	Filters      map[string]string `json:"filters,omitempty"`
+	Results      []LoggedResult    `json:"results,omitempty"`
+	Conversation string            `json:"conversation,omitempty"`
+	Rank         int               `json:"rank,omitempty"`
+	// Cursor is the cursor of the page of results that the event happened on.
+	Cursor     string `json:"cursor,omitempty"`
+	Target     string `json:"target,omitempty"`
+	Duration   int64  `json:"duration,omitempty"`
+	ClientTime int64  `json:"client_time,omitempty"`
+
+	Time    time.Time         `json:"time"`
+	Session string            `json:"session"`
+	User    string            `json:"user,omitempty"`
+	Labels  map[string]string `json:"labels,omitempty"`
+}
+
+// logSink persists logged events.
+type logSink interface {
+	Write(events []LogEvent) error
+}
+
+// fileSink appends events as JSON lines to a file, which is rotated once it grows beyond a maximum size.
+type fileSink struct {
+	sync.Mutex
+	path    string
+	maxSize int64
+	f       *os.File
+	size    int64
+}
+
+func newFileSink(path string, maxSize int64) (*fileSink, error) {
+	s := &fileSink{path: path, maxSize: maxSize}
+	return s, s.open()
+}
+
+func (s *fileSink) open() error {
+	f, err := os.OpenFile(s.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	s.f = f
+	s.size = info.Size()
+	return nil
+}
+
+// rotate moves the current file aside, naming it after the time it was rotated, and starts a new one.
+func (s *fileSink) rotate() error {
+	if err := s.f.Close(); err != nil {
+		return err
+	}
+	rotated := s.path + "." + time.Now().Format("20060102-150405")
+	for i := 1; ; i++ {
+		if _, err := os.Stat(rotated); os.IsNotExist(err) {
+			break
+		}
+		rotated = fmt.Sprintf("%s.%s.%d", s.path, time.Now().Format("20060102-150405"), i)
+	}
+	if err := os.Rename(s.path, rotated); err != nil {
+		return err
+	}
+	return s.open()
+}
+
+func (s *fileSink) Write(events []LogEvent) error {
+	s.Lock()
+	defer s.Unlock()
+	for _, event := range events {
+		b, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		if s.size > 0 && s.size+int64(len(b))+1 > s.maxSize {
+			if err := s.rotate(); err != nil {
+				return err
+			}
+		}
+		n, err := s.f.Write(append(b, '\n'))
+		s.size += int64(n)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// elasticSink indexes events into a dedicated elasticsearch index.
+type elasticSink struct {
+	es    *elastic.Client
+	index string
+}
+
+func (s *elasticSink) Write(events []LogEvent) error {
+	bulk := s.es.Bulk().Index(s.index)
+	for _, event := range events {
+		bulk.Add(elastic.NewBulkIndexRequest().Doc(event))
+	}
+	resp, err := bulk.Do(context.Background())
+	if err != nil {
+		return err
+	}
+	if failed := resp.Failed(); len(failed) > 0 && failed[0].Error != nil {
+		return fmt.Errorf("could not index log event: %s", failed[0].Error.Reason)
+	}
+	return nil
+}
+
+// LoggingAddon records the queries users issue and their interactions with the results,
+// as sent by a script that is included in every page.
+type LoggingAddon struct {
+	api    pecan.ChatAPI
+	sink   logSink
+	secret []byte
+
+	subscribersMu sync.RWMutex
+	subscribers   []func(events []LogEvent)
+}
+
+// Subscribe calls f with the events of every request once they have been recorded,
+// so that other addons can act on the interactions of users.
+func (addon *LoggingAddon) Subscribe(f func(events []LogEvent)) {
+	addon.subscribersMu.Lock()
+	defer addon.subscribersMu.Unlock()
+	addon.subscribers = append(addon.subscribers, f)
+}
+
+func NewLoggingAddon() *LoggingAddon {
+	return &LoggingAddon{}
+}
+
+func (addon *LoggingAddon) Initialise(es *elastic.Client, api pecan.ChatAPI, config *pecan.Config) {
+	addon.api = api
+	addon.secret = []byte(config.Secrets.Cookie)
+	switch config.Logging.Output {
+	case "elasticsearch":
+		index := config.Logging.Index
+		if len(index) == 0 {
+			index = config.Elasticsearch.Index + "-log"
+		}
+		addon.sink = &elasticSink{es: es, index: index}
+	default:
+		path := config.Logging.Path
+		if len(path) == 0 {
+			path = "pecan-log.jsonl"
+		}
+		maxSize := config.Logging.MaxSize
+		if maxSize <= 0 {
+			maxSize = DefaultLogMaxSize
+		}
+		sink, err := newFileSink(path, maxSize)
+		if err != nil {
+			panic(err)
+		}
+		addon.sink = sink
+	}
+}
+
+// pseudonym replaces an identifier with a keyed hash of it, so that events by the same
+// session or user can be linked without revealing who they are.
+func (addon *LoggingAddon) pseudonym(id string) string {
+	mac := hmac.New(sha256.New, addon.secret)
+	mac.Write([]byte(id))
+	return hex.EncodeToString(mac.Sum(nil))[:16]
+}
+
+// identify returns the pseudonymous session and user of the request, starting a new logging session
+// if there is not one already. Users are identified by who they are rather than by their login,
+// so that they have the same pseudonym every time they log in.
+func (addon *LoggingAddon) identify(c *gin.Context) (string, string) {
+	session := sessions.Default(c)
+	id, ok := session.Get("log_session").(string)
+	if !ok || len(id) == 0 {
+		b := make([]byte, 16)
+		if _, err := rand.Read(b); err != nil {
+			panic(err)
+		}
+		id = hex.EncodeToString(b)
+		session.Set("log_session", id)
+		if err := session.Save(); err != nil {
+			panic(err)
+		}
+	}
+
+	var user string
+	if u, err := addon.api.UserID(c); err == nil && len(u) > 0 {
+		user = addon.pseudonym(u)
+	}
+	return addon.pseudonym(id), user
+}
+
+// Handler serves the logging script to GET requests and records the events POSTed by it.
+func (addon *LoggingAddon) Handler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.Method == http.MethodGet {
+			c.Data(http.StatusOK, "application/javascript", loggingScript)
+			return
+		}
+
+		// Beacons are sent as plain text, so the body is decoded regardless of its content type.
+		b, err := ioutil.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, MaxLogRequestSize))
+		if err != nil {
+			c.AbortWithStatus(http.StatusRequestEntityTooLarge)
+			return
+		}
+		var events []LogEvent
+		if err := json.Unmarshal(b, &events); err != nil {
+			var event LogEvent
+			if err := json.Unmarshal(b, &event); err != nil {
+				c.AbortWithStatus(http.StatusBadRequest)
+				return
+			}
+			events = []LogEvent{event}
+		}
+		if len(events) > MaxLogRequestEvents {
+			c.AbortWithStatus(http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		session, user := addon.identify(c)
+		labels := c.GetStringMapString(LogLabelsKey)
+		now := time.Now()
+		for i := range events {
+			events[i].Time = now
+			events[i].Session = session
+			events[i].User = user
+			if len(labels) > 0 {
+				events[i].Labels = labels
+			}
+		}
+
+		if err := addon.sink.Write(events); err != nil {
+			panic(err)
+		}
+		addon.subscribersMu.RLock()
+		for _, f := range addon.subscribers {
+			f(events)
+		}
+		addon.subscribersMu.RUnlock()
+		c.Status(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,94 @@
+// Sends queries and interactions with pecan to the logging addon.
+(function () {
+    var endpoint = "/addon/logging";
+    var opened = Date.now();
+
+    function send(events) {
+        var body = JSON.stringify(events);
+        if (!(navigator.sendBeacon && navigator.sendBeacon(endpoint, body))) {
+            fetch(endpoint, {method: "POST", body: body, keepalive: true, credentials: "same-origin"});
+        }
+    }
+
+    function event(type, fields) {
+        var e = {type: type, path: window.location.pathname, client_time: Date.now()};
+        var results = document.querySelector("[data-cursor]");
+        if (results && results.getAttribute("data-cursor")) {
+            e.cursor = results.getAttribute("data-cursor");
+        }
+        for (var key in fields) {
+            e[key] = fields[key];
+        }
+        return e;
+    }
+
+    function result(element) {
+        var card = element.closest("[data-conversation-id]");
+        if (!card) {
+            return {};
+        }
+        return {
+            conversation: card.getAttribute("data-conversation-id"),
+            rank: parseInt(card.getAttribute("data-rank"), 10) || 0
+        };
+    }
+
+    document.addEventListener("DOMContentLoaded", function () {
+        if (window.location.pathname !== "/search") {
+            return;
+        }
+        var params = new URLSearchParams(window.location.search);
+        var filters = {};
+        ["from", "to", "channel", "user", "cursor"].forEach(function (key) {
+            if (params.get(key)) {
+                filters[key] = params.get(key);
+            }
+        });
+        var results = [];
+        document.querySelectorAll("[data-conversation-id]").forEach(function (card) {
+            results.push({
+                conversation: card.getAttribute("data-conversation-id"),
+                rank: parseInt(card.getAttribute("data-rank"), 10) || 0
+            });
+        });
+        send([
+            event("query", {query: params.get("q") || "", filters: filters}),
+            event("results", {query: params.get("q") || "", results: results})
+        ]);
+    });
+
+    // Previous and Next Messages are forms, so they are logged as they are submitted.
+    document.addEventListener("submit", function (e) {
+        var form = e.target;
+        if (form.getAttribute("action") !== "/more_messages") {
+            return;
+        }
+        var direction = form.querySelector("[name=prev_next]");
+        var fields = result(form);
+        fields.target = direction && direction.value === "1" ? "next_messages" : "previous_messages";
+        send([event("click", fields)]);
+    });
+
+    document.addEventListener("click", function (e) {
+        var link = e.target.closest("a, .copy-link");
+        if (!link) {
+            return;
+        }
+        var fields = result(link);
+        if (link.closest(".export")) {
+            fields.target = link.textContent.trim();
+            send([event("export", fields)]);
+        } else if (link.classList.contains("copy-link")) {
+            fields.target = "copy_link";
+            send([event("click", fields)]);
+        } else if (fields.conversation) {
+            fields.target = link.getAttribute("href");
+            send([event("click", fields)]);
+        }
+    });
+
+    // Dwell time is the time the page was open before the user left it.
+    window.addEventListener("pagehide", function () {
+        send([event("dwell", {duration: Date.now() - opened})]);
+    });
+})();
@@ -0,0 +1,49 @@
+package addon
+
+import (
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-contrib/sessions/cookie"
+	"github.com/gin-gonic/gin"
+	"github.com/ielab/pecan"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoggingLimits(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	config := new(pecan.Config)
+	config.Logging.Path = filepath.Join(t.TempDir(), "log.jsonl")
+	addon := NewLoggingAddon()
+	addon.Initialise(nil, pecan.NewNoChatAPI(), config)
+
+	router := gin.New()
+	router.Use(sessions.Sessions("pecan", cookie.NewStore([]byte("secret"))))
+	router.POST("/addon/logging", addon.Handler())
+
+	events := func(n int) string {
+		return "[" + strings.TrimSuffix(strings.Repeat(`{"type":"click"},`, n), ",") + "]"
+	}
+	bodies := []struct {
+		name string
+		body string
+		code int
+	}{
+		{"beacon", events(2), http.StatusNoContent},
+		{"most events", events(MaxLogRequestEvents), http.StatusNoContent},
+		{"too many events", events(MaxLogRequestEvents + 1), http.StatusRequestEntityTooLarge},
+		{"too large", `{"type":"click","query":"` + strings.Repeat("a", MaxLogRequestSize) + `"}`, http.StatusRequestEntityTooLarge},
+		{"malformed", `{"type":`, http.StatusBadRequest},
+	}
+	for _, body := range bodies {
+		t.Run(body.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/addon/logging", strings.NewReader(body.body)))
+			if w.Code != body.code {
+				t.Errorf("responded %d, want %d", w.Code, body.code)
+			}
+		})
+	}
+}
@@ -0,0 +1,456 @@
+package addon
+
+import (
+	"bufio"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	"github.com/ielab/pecan"
+	"github.com/olivere/elastic/v7"
+	"html/template"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//go:embed userstudy.html
+var userStudyTemplate string
+
+// Steps that a participant goes through for each task of a study.
+const (
+	stepPre    = "pre"
+	stepSearch = "search"
+	stepPost   = "post"
+	stepDone   = "done"
+)
+
+// errParticipantTaken is shown to someone who starts the study with the id of a participant who already has,
+// since participants only continue the study from the session they started it in.
+var errParticipantTaken = errors.New("this participant id has already been used to start the study")
+
+// Question is a single question of a questionnaire.
+// Questions of type "scale" are answered on a scale from 1 to Scale,
+// questions of type "choice" with one of Options, and all other questions with free text.
+type Question struct {
+	Id      string   `json:"id"`
+	Text    string   `json:"text"`
+	Type    string   `json:"type"`
+	Scale   int      `json:"scale,omitempty"`
+	Options []string `json:"options,omitempty"`
+}
+
+// ScalePoints are the points that a question of type "scale" can be answered with.
+func (q Question) ScalePoints() []int {
+	points := make([]int, q.Scale)
+	for i := range points {
+		points[i] = i + 1
+	}
+	return points
+}
+
+// StudyTopic is an information need that participants search for conversations about.
+type StudyTopic struct {
+	Id          string `json:"id"`
+	Title       string `json:"title"`
+	Description string `json:"description"`
+}
+
+// StudyVariant is a system that participants use to search, defined by the pipeline it uses.
+type StudyVariant struct {
+	Name string `json:"name"`
+	pecan.Pipeline
+}
+
+// Study is the definition of a user study, loaded from a JSON file.
+type Study struct {
+	Name         string         `json:"name"`
+	Instructions string         `json:"instructions"`
+	Topics       []StudyTopic   `json:"topics"`
+	Variants     []StudyVariant `json:"variants"`
+	PreTask      []Question     `json:"pre_task"`
+	PostTask     []Question     `json:"post_task"`
+}
+
+// StudyTask is a topic that a participant searches for using a variant.
+type StudyTask struct {
+	Topic   StudyTopic
+	Variant StudyVariant
+}
+
+// participant is the progress of a participant through their tasks.
+type participant struct {
+	Id    string
+	Index int
+	Tasks []StudyTask
+	Task  int
+	Step  string
+}
+
+// TaskNumber is the position of the current task of the participant, counting from one.
+func (p *participant) TaskNumber() int {
+	return p.Task + 1
+}
+
+// studyRecord is a line of the output file of a study.
+// The state of every participant can be recovered by replaying the records in order.
+type studyRecord struct {
+	Type        string            `json:"type"`
+	Time        time.Time         `json:"time"`
+	Participant string            `json:"participant"`
+	Index       int               `json:"index,omitempty"`
+	Task        int               `json:"task"`
+	Topic       string            `json:"topic,omitempty"`
+	Variant     string            `json:"variant,omitempty"`
+	Step        string            `json:"step,omitempty"`
+	Responses   map[string]string `json:"responses,omitempty"`
+}
+
+// latinSquareRow is row r of a balanced latin square of size n, used to order the topics of a participant
+// so that each topic is seen in each position, and after each other topic, equally often.
+// For odd n the square is balanced over 2n rows by reversing every second block of n rows.
+func latinSquareRow(n, r int) []int {
+	row := make([]int, n)
+	for j := range row {
+		v := j / 2
+		if j%2 == 1 {
+			v = n - (j+1)/2
+		}
+		row[j] = (v + r) % n
+	}
+	if n%2 == 1 && (r/n)%2 == 1 {
+		for i, j := 0, n-1; i < j; i, j = i+1, j-1 {
+			row[i], row[j] = row[j], row[i]
+		}
+	}
+	return row
+}
+
+// validateVariants checks that every variant names functions that exist. Variants that search the same way
+// are allowed, since there is only one implementation of each function so far, but are logged as a warning
+// because participants would be compared against themselves.
+func (study Study) validateVariants() error {
+	seen := make(map[pecan.Pipeline]string)
+	for _, variant := range study.Variants {
+		pipeline, err := variant.Pipeline.Canonical()
+		if err != nil {
+			return fmt.Errorf("userstudy: variant %s: %w", variant.Name, err)
+		}
+		if other, ok := seen[pipeline]; ok {
+			log.Printf("userstudy: warning: variants %s and %s use the same pipeline", other, variant.Name)
+			continue
+		}
+		seen[pipeline] = variant.Name
+	}
+	return nil
+}
+
+// tasksFor rotates the topics and variants of the study for the participant with the index.
+func (study Study) tasksFor(index int) []StudyTask {
+	order := latinSquareRow(len(study.Topics), index)
+	tasks := make([]StudyTask, len(order))
+	for j, t := range order {
+		tasks[j] = StudyTask{
+			Topic:   study.Topics[t],
+			Variant: study.Variants[(index+j)%len(study.Variants)],
+		}
+	}
+	return tasks
+}
+
+// UserStudyAddon runs a within-subjects user study: participants complete a task for each topic of the study,
+// answering questionnaires before and after searching with the variant assigned to them for that task.
+// While a participant is searching, their requests use the pipeline of the variant and any interactions
+// recorded by the logging addon are labelled with the participant, topic, and variant.
+type UserStudyAddon struct {
+	sync.Mutex
+	study        Study
+	participants map[string]*participant
+	output       *os.File
+	exportKey    string
+	page         *template.Template
+}
+
+func NewUserStudyAddon() *UserStudyAddon {
+	return &UserStudyAddon{
+		participants: make(map[string]*participant),
+	}
+}
+
+func (addon *UserStudyAddon) Initialise(es *elastic.Client, api pecan.ChatAPI, config *pecan.Config) {
+	b, err := ioutil.ReadFile(config.UserStudy.Study)
+	if err != nil {
+		panic(err)
+	}
+	err = json.Unmarshal(b, &addon.study)
+	if err != nil {
+		panic(err)
+	}
+	if len(addon.study.Topics) == 0 || len(addon.study.Variants) == 0 {
+		panic("userstudy: a study must have at least one topic and variant")
+	}
+	err = addon.study.validateVariants()
+	if err != nil {
+		panic(err)
+	}
+
+	output := config.UserStudy.Output
+	if len(output) == 0 {
+		output = "userstudy.jsonl"
+	}
+	err = addon.replay(output)
+	if err != nil {
+		panic(err)
+	}
+	addon.output, err = os.OpenFile(output, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		panic(err)
+	}
+
+	addon.exportKey = config.UserStudy.ExportKey
+	addon.page = template.Must(template.New("userstudy").Parse(userStudyTemplate))
+}
+
+// replay restores the state of participants from the records of a previous run of the study.
+func (addon *UserStudyAddon) replay(path string) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var record studyRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return err
+		}
+		switch record.Type {
+		case "assign":
+			addon.participants[record.Participant] = &participant{
+				Id:    record.Participant,
+				Index: record.Index,
+				Tasks: addon.study.tasksFor(record.Index),
+			}
+		case "step":
+			if p, ok := addon.participants[record.Participant]; ok {
+				p.Task = record.Task
+				p.Step = record.Step
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+// record appends a record to the output of the study. The caller must hold the lock.
+func (addon *UserStudyAddon) record(record studyRecord) {
+	record.Time = time.Now()
+	b, err := json.Marshal(record)
+	if err != nil {
+		panic(err)
+	}
+	_, err = addon.output.Write(append(b, '\n'))
+	if err != nil {
+		panic(err)
+	}
+}
+
+// firstStep is the first step of a task, skipping questionnaires that the study does not have.
+func (addon *UserStudyAddon) firstStep() string {
+	if len(addon.study.PreTask) > 0 {
+		return stepPre
+	}
+	return stepSearch
+}
+
+// advance moves a participant to the step after the one they are on. The caller must hold the lock.
+func (addon *UserStudyAddon) advance(p *participant) {
+	switch p.Step {
+	case stepPre:
+		p.Step = stepSearch
+	case stepSearch:
+		if len(addon.study.PostTask) > 0 {
+			p.Step = stepPost
+			break
+		}
+		fallthrough
+	case stepPost:
+		p.Task++
+		p.Step = addon.firstStep()
+		if p.Task >= len(p.Tasks) {
+			p.Step = stepDone
+		}
+	}
+	record := studyRecord{Type: "step", Participant: p.Id, Task: p.Task, Step: p.Step}
+	if p.Step != stepDone {
+		record.Topic = p.Tasks[p.Task].Topic.Id
+		record.Variant = p.Tasks[p.Task].Variant.Name
+	}
+	addon.record(record)
+}
+
+// assign starts the study for a participant, generating an id for them if they do not have one.
+// An id that has already started the study is not handed out again. The caller must hold the lock.
+func (addon *UserStudyAddon) assign(id string) (*participant, error) {
+	index := len(addon.participants)
+	if len(id) == 0 {
+		for n := index + 1; len(id) == 0 || addon.participants[id] != nil; n++ {
+			id = "P" + strconv.Itoa(n)
+		}
+	}
+	if _, ok := addon.participants[id]; ok {
+		return nil, errParticipantTaken
+	}
+	p := &participant{
+		Id:    id,
+		Index: index,
+		Tasks: addon.study.tasksFor(index),
+		Step:  addon.firstStep(),
+	}
+	addon.participants[id] = p
+	addon.record(studyRecord{Type: "assign", Participant: p.Id, Index: p.Index})
+	addon.record(studyRecord{Type: "step", Participant: p.Id, Task: p.Task, Step: p.Step, Topic: p.Tasks[0].Topic.Id, Variant: p.Tasks[0].Variant.Name})
+	return p, nil
+}
+
+// current is the participant of the session of the request, if any. The caller must hold the lock.
+func (addon *UserStudyAddon) current(c *gin.Context) (*participant, bool) {
+	id, ok := sessions.Default(c).Get("userstudy_participant").(string)
+	if !ok {
+		return nil, false
+	}
+	p, ok := addon.participants[id]
+	return p, ok
+}
+
+// Middleware searches using the variant of the task of a participant while they are searching,
+// and labels their logged interactions.
+func (addon *UserStudyAddon) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		addon.Lock()
+		p, ok := addon.current(c)
+		if ok && p.Step != stepDone {
+			task := p.Tasks[p.Task]
+			if p.Step == stepSearch {
+				c.Set(pecan.PipelineKey, task.Variant.Pipeline)
+			}
+			addLogLabels(c, map[string]string{
+				"participant": p.Id,
+				"task":        strconv.Itoa(p.Task),
+				"topic":       task.Topic.Id,
+				"variant":     task.Variant.Name,
+				"step":        p.Step,
+			})
+		}
+		addon.Unlock()
+		c.Next()
+	}
+}
+
+type userStudyPage struct {
+	Study       Study
+	Participant *participant
+	Task        StudyTask
+	Questions   []Question
+	Error       string
+}
+
+// Handler shows participants the step of the study they are on, and records their progress through it.
+// The records of the study can be downloaded with ?action=export&key=<export_key>.
+func (addon *UserStudyAddon) Handler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Query("action") == "export" {
+			addon.export(c)
+			return
+		}
+
+		addon.Lock()
+		defer addon.Unlock()
+
+		p, ok := addon.current(c)
+		if c.Request.Method == http.MethodPost {
+			switch c.PostForm("action") {
+			case "start":
+				if !ok {
+					var err error
+					p, err = addon.assign(strings.TrimSpace(c.PostForm("participant")))
+					if err != nil {
+						c.Status(http.StatusConflict)
+						addon.render(c, userStudyPage{Study: addon.study, Error: err.Error()})
+						return
+					}
+					session := sessions.Default(c)
+					session.Set("userstudy_participant", p.Id)
+					if err := session.Save(); err != nil {
+						panic(err)
+					}
+				}
+			case "submit":
+				if ok && (p.Step == stepPre || p.Step == stepPost) {
+					questions := addon.study.PreTask
+					if p.Step == stepPost {
+						questions = addon.study.PostTask
+					}
+					responses := make(map[string]string)
+					for _, q := range questions {
+						responses[q.Id] = c.PostForm(q.Id)
+					}
+					task := p.Tasks[p.Task]
+					addon.record(studyRecord{Type: "response", Participant: p.Id, Task: p.Task, Step: p.Step, Topic: task.Topic.Id, Variant: task.Variant.Name, Responses: responses})
+					addon.advance(p)
+				}
+			case "finish":
+				if ok && p.Step == stepSearch {
+					addon.advance(p)
+				}
+			}
+			c.Redirect(http.StatusFound, "/addon/userstudy")
+			return
+		}
+
+		page := userStudyPage{Study: addon.study}
+		if ok {
+			page.Participant = p
+			if p.Step != stepDone {
+				page.Task = p.Tasks[p.Task]
+			}
+			switch p.Step {
+			case stepPre:
+				page.Questions = addon.study.PreTask
+			case stepPost:
+				page.Questions = addon.study.PostTask
+			}
+		}
+		addon.render(c, page)
+	}
+}
+
+func (addon *UserStudyAddon) render(c *gin.Context, page userStudyPage) {
+	c.Header("Content-Type", "text/html; charset=utf-8")
+	if err := addon.page.Execute(c.Writer, page); err != nil {
+		panic(err)
+	}
+}
+
+// export downloads the records of the study, so long as the export key is configured and given.
+func (addon *UserStudyAddon) export(c *gin.Context) {
+	if len(addon.exportKey) == 0 || c.Query("key") != addon.exportKey {
+		c.AbortWithStatus(http.StatusForbidden)
+		return
+	}
+	addon.Lock()
+	defer addon.Unlock()
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, "userstudy.jsonl"))
+	c.File(addon.output.Name())
+}
@@ -0,0 +1,49 @@
+package addon
+
+import (
+	"errors"
+	"github.com/ielab/pecan"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// studyConfig writes the study to a temporary directory and returns a configuration that runs it.
+func studyConfig(t *testing.T, study string) *pecan.Config {
+	t.Helper()
+	dir := t.TempDir()
+	config := new(pecan.Config)
+	config.UserStudy.Study = filepath.Join(dir, "study.json")
+	config.UserStudy.Output = filepath.Join(dir, "userstudy.jsonl")
+	if err := ioutil.WriteFile(config.UserStudy.Study, []byte(study), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return config
+}
+
+func TestUserStudyVariants(t *testing.T) {
+	config := studyConfig(t, `{
+		"name": "study",
+		"topics": [{"id": "1", "title": "one"}, {"id": "2", "title": "two"}],
+		"variants": [{"name": "A"}, {"name": "B", "bounder": "time", "aggregator": "time", "scorer": "message"}]
+	}`)
+	addon := NewUserStudyAddon()
+	addon.Initialise(nil, pecan.NewNoChatAPI(), config)
+	defer addon.output.Close()
+
+	for index, want := range [][]string{{"A", "B"}, {"B", "A"}} {
+		tasks := addon.study.tasksFor(index)
+		for i, task := range tasks {
+			if task.Variant.Name != want[i] {
+				t.Errorf("participant %d searches task %d with %s, want %s", index, i, task.Variant.Name, want[i])
+			}
+		}
+	}
+}
+
+func TestUserStudyUnknownFunction(t *testing.T) {
+	study := Study{Variants: []StudyVariant{{Name: "A"}, {Name: "B", Pipeline: pecan.Pipeline{Scorer: "bm42"}}}}
+	if err := study.validateVariants(); !errors.Is(err, pecan.ErrUnknownFunction) {
+		t.Errorf("returned %v, want %v", err, pecan.ErrUnknownFunction)
+	}
+}
@@ -9,6 +9,16 @@ import (
 type ChatAPI interface {
 	ConvertSearchResponseToMessages(resp *elastic.SearchResult) ([]Message, error)
 	GetMessages(es *elastic.Client, ctx context.Context, request SearchRequest) ([]Message, error)
+	GetFacets(es *elastic.Client, ctx context.Context, request SearchRequest) (Facets, error)
+	CanReadChannel(c *gin.Context, channel string) (bool, error)
+	// ReadableChannels are the channels the authenticated user can read, unless all is true,
+	// in which case they can read every channel.
+	ReadableChannels(c *gin.Context) (channels []string, all bool, err error)
+	// UserID identifies the authenticated user the same way every time they log in,
+	// and is empty when users do not log in.
+	UserID(c *gin.Context) (string, error)
+	HandleLogin(c *gin.Context)
 	HandleOAuth(c *gin.Context)
 	HandleAuthentication(c *gin.Context)
+	HandleLogout(c *gin.Context)
 }
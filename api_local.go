@@ -0,0 +1,337 @@
+package pecan
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	"github.com/olivere/elastic/v7"
+	"golang.org/x/crypto/bcrypt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// LocalUser is an account that can log in to the local chat API.
+type LocalUser struct {
+	Username     string   `json:"username"`
+	PasswordHash string   `json:"password_hash"`
+	Groups       []string `json:"groups,omitempty"`
+}
+
+// ReadLocalUsers reads the accounts in a users file. A file that does not exist has no accounts.
+func ReadLocalUsers(path string) ([]LocalUser, error) {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var users []LocalUser
+	err = json.Unmarshal(b, &users)
+	return users, err
+}
+
+// WriteLocalUsers replaces the accounts in a users file, which only its owner can read.
+func WriteLocalUsers(path string, users []LocalUser) error {
+	b, err := json.MarshalIndent(users, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(b, '\n'), 0600)
+}
+
+// SetLocalUser adds an account with a bcrypt hash of its password, or replaces the account with the same username.
+func SetLocalUser(users []LocalUser, username, password string, groups []string) ([]LocalUser, error) {
+	if len(username) == 0 || len(password) == 0 {
+		return users, errors.New("a username and password are required")
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return users, err
+	}
+	user := LocalUser{Username: username, PasswordHash: string(hash), Groups: groups}
+	for i := range users {
+		if users[i].Username == username {
+			users[i] = user
+			return users, nil
+		}
+	}
+	users = append(users, user)
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Username < users[j].Username
+	})
+	return users, nil
+}
+
+// ACL maps users, and the groups they are in, to the channels they can read, where "*" is every channel.
+type ACL struct {
+	Users  map[string][]string `json:"users"`
+	Groups map[string][]string `json:"groups"`
+}
+
+// ReadACL reads an ACL file.
+func ReadACL(path string) (ACL, error) {
+	var acl ACL
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return acl, err
+	}
+	err = json.Unmarshal(b, &acl)
+	return acl, err
+}
+
+// Channels are the channels that a user can read, directly or through their groups.
+func (acl ACL) Channels(user LocalUser) []string {
+	var channels []string
+	seen := make(map[string]bool)
+	add := func(granted []string) {
+		for _, channel := range granted {
+			if !seen[channel] {
+				seen[channel] = true
+				channels = append(channels, channel)
+			}
+		}
+	}
+	add(acl.Users[user.Username])
+	for _, group := range user.Groups {
+		add(acl.Groups[group])
+	}
+	return channels
+}
+
+// ErrLoginForm is the reason a login is refused when it was not posted from a login form this browser was given.
+var ErrLoginForm = errors.New("the login form was not opened in this browser, or has already been used")
+
+// LoginToken creates a token for the login form to post back, which HandleLogin checks against the session
+// so that other sites cannot log browsers in to an account of their choosing.
+func LoginToken(c *gin.Context) string {
+	session := sessions.Default(c)
+	token := randState()
+	session.Set("login_token", token)
+	if err := session.Save(); err != nil {
+		panic(err)
+	}
+	return token
+}
+
+// dummyHash is compared against when a username does not exist, so that logins take as long either way.
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("pecan"), bcrypt.DefaultCost)
+
+// LocalChatAPI logs users in with the accounts in a users file, and grants them the channels in an ACL file.
+// Both files are read again when they change, so accounts can be added and access revoked without a restart.
+// Messages are converted as NoChatAPI converts them.
+type LocalChatAPI struct {
+	*NoChatAPI
+	usersPath string
+	aclPath   string
+	tokens    TokenStore
+
+	mu       sync.Mutex
+	users    map[string]LocalUser
+	usersMod time.Time
+	acl      ACL
+	aclMod   time.Time
+}
+
+func NewLocalChatAPI(config *Config, tokens TokenStore) *LocalChatAPI {
+	return &LocalChatAPI{
+		NoChatAPI: NewNoChatAPI(),
+		usersPath: config.API.Local.Users,
+		aclPath:   config.API.Local.ACL,
+		tokens:    tokens,
+	}
+}
+
+// modified is when the file at path was last changed, or the zero time if it does not exist.
+func modified(path string) (time.Time, error) {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	return info.ModTime(), nil
+}
+
+// load reads the users and ACL files again if they have changed, and returns the user with a username.
+func (api *LocalChatAPI) load(username string) (LocalUser, ACL, bool, error) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+
+	mod, err := modified(api.usersPath)
+	if err != nil {
+		return LocalUser{}, api.acl, false, err
+	}
+	if api.users == nil || !mod.Equal(api.usersMod) {
+		users, err := ReadLocalUsers(api.usersPath)
+		if err != nil {
+			return LocalUser{}, api.acl, false, err
+		}
+		api.users = make(map[string]LocalUser)
+		for _, user := range users {
+			api.users[user.Username] = user
+		}
+		api.usersMod = mod
+	}
+
+	mod, err = modified(api.aclPath)
+	if err != nil {
+		return LocalUser{}, api.acl, false, err
+	}
+	if !mod.Equal(api.aclMod) {
+		acl, err := ReadACL(api.aclPath)
+		if err != nil && !os.IsNotExist(err) {
+			return LocalUser{}, api.acl, false, err
+		}
+		api.acl = acl
+		api.aclMod = mod
+	}
+
+	user, ok := api.users[username]
+	return user, api.acl, ok, nil
+}
+
+// user is the logged in user of a request.
+func (api *LocalChatAPI) user(c *gin.Context) (LocalUser, ACL, error) {
+	token, _ := sessions.Default(c).Get("token").(string)
+	if len(token) == 0 {
+		return LocalUser{}, ACL{}, ErrTokenNotFound
+	}
+	username, err := api.tokens.Get(token)
+	if err != nil {
+		return LocalUser{}, ACL{}, err
+	}
+	user, acl, ok, err := api.load(username)
+	if err != nil {
+		return user, acl, err
+	}
+	if !ok {
+		// The account has been removed since they logged in.
+		return user, acl, ErrTokenNotFound
+	}
+	return user, acl, nil
+}
+
+// ReadableChannels are the channels that the ACL grants the logged in user.
+func (api *LocalChatAPI) ReadableChannels(c *gin.Context) ([]string, bool, error) {
+	user, acl, err := api.user(c)
+	if err != nil {
+		return nil, false, err
+	}
+	channels := acl.Channels(user)
+	if containsString(channels, AllChannels) {
+		return nil, true, nil
+	}
+	return channels, false, nil
+}
+
+func (api *LocalChatAPI) GetMessages(es *elastic.Client, ctx context.Context, request SearchRequest) ([]Message, error) {
+	channels, all, err := api.ReadableChannels(request.Context)
+	if err != nil || (!all && len(channels) == 0) {
+		return []Message{}, err
+	}
+	resp, err := queryMessages(es, ctx, channels, request)
+	if err != nil {
+		return nil, err
+	}
+	return api.ConvertSearchResponseToMessages(resp)
+}
+
+func (api *LocalChatAPI) GetFacets(es *elastic.Client, ctx context.Context, request SearchRequest) (Facets, error) {
+	channels, all, err := api.ReadableChannels(request.Context)
+	if err != nil || (!all && len(channels) == 0) {
+		return Facets{}, err
+	}
+	resp, err := queryFacets(es, ctx, channels, request)
+	if err != nil {
+		return Facets{}, err
+	}
+	return convertSearchResponseToFacets(resp), nil
+}
+
+// UserID is the username of the logged in user.
+func (api *LocalChatAPI) UserID(c *gin.Context) (string, error) {
+	user, _, err := api.user(c)
+	return user.Username, err
+}
+
+// CanReadChannel checks whether the ACL grants the logged in user the channel.
+func (api *LocalChatAPI) CanReadChannel(c *gin.Context, channel string) (bool, error) {
+	channels, all, err := api.ReadableChannels(c)
+	if err != nil {
+		return false, err
+	}
+	return all || containsString(channels, channel), nil
+}
+
+// HandleLogin logs users in with the username and password posted from the login form.
+func (api *LocalChatAPI) HandleLogin(c *gin.Context) {
+	if c.Request.Method != http.MethodPost {
+		c.Redirect(http.StatusFound, "/login")
+		return
+	}
+	session := sessions.Default(c)
+	token, _ := session.Get("login_token").(string)
+	// The token may only be used once.
+	session.Delete("login_token")
+	if err := session.Save(); err != nil {
+		panic(err)
+	}
+	if len(token) == 0 || subtle.ConstantTimeCompare([]byte(token), []byte(c.PostForm("login_token"))) != 1 {
+		ErrorPage(c, http.StatusBadRequest, "Login Failed", "Please log in again, "+ErrLoginForm.Error()+".")
+		return
+	}
+
+	user, _, ok, err := api.load(c.PostForm("username"))
+	if err != nil {
+		panic(err)
+	}
+	hash := dummyHash
+	if ok {
+		hash = []byte(user.PasswordHash)
+	}
+	if err := bcrypt.CompareHashAndPassword(hash, []byte(c.PostForm("password"))); err != nil || !ok {
+		ErrorPage(c, http.StatusForbidden, "Login Failed", "The username or password is incorrect.")
+		return
+	}
+
+	token = randState()
+	if err := api.tokens.Put(token, user.Username); err != nil {
+		panic(err)
+	}
+	session.Set("token", token)
+	if err := session.Save(); err != nil {
+		panic(err)
+	}
+	c.Redirect(http.StatusFound, "/")
+}
+
+// HandleOAuth does nothing, since local accounts log in with a form.
+func (api *LocalChatAPI) HandleOAuth(c *gin.Context) {
+	c.Redirect(http.StatusFound, "/login")
+}
+
+func (api *LocalChatAPI) HandleAuthentication(c *gin.Context) {
+	if _, _, err := api.user(c); err != nil {
+		RequireLogin(c)
+	}
+}
+
+// HandleLogout forgets the logged in user.
+func (api *LocalChatAPI) HandleLogout(c *gin.Context) {
+	token, _ := sessions.Default(c).Get("token").(string)
+	if len(token) == 0 {
+		return
+	}
+	if err := api.tokens.Revoke(token); err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,144 @@
+package pecan
+
+import (
+	"encoding/json"
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-contrib/sessions/cookie"
+	"github.com/gin-gonic/gin"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeLocalAccounts writes a users file in which alice's password is "password", and an ACL file
+// that grants her C1, returning a config that uses them.
+func writeLocalAccounts(t *testing.T) *Config {
+	t.Helper()
+	dir := t.TempDir()
+	config := new(Config)
+	config.API.Use = "local"
+	config.API.Local.Users = filepath.Join(dir, "users.json")
+	config.API.Local.ACL = filepath.Join(dir, "acl.json")
+
+	users, err := SetLocalUser(nil, "alice", "password", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteLocalUsers(config.API.Local.Users, users); err != nil {
+		t.Fatal(err)
+	}
+	acl, err := json.Marshal(ACL{Users: map[string][]string{"alice": {"C1"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(config.API.Local.ACL, acl, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return config
+}
+
+// localRouter serves a login form for a local chat API, and the channels that the logged in user can read.
+func localRouter(t *testing.T) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	config := writeLocalAccounts(t)
+	api := NewLocalChatAPI(config, NewMemoryTokenStore(0))
+
+	router := gin.New()
+	router.SetHTMLTemplate(template.Must(template.New("error.html").Parse("{{ .Title }}: {{ .Message }}")))
+	router.Use(sessions.Sessions("pecan", cookie.NewStore([]byte("secret"))))
+	router.GET("/login", func(c *gin.Context) {
+		c.String(http.StatusOK, LoginToken(c))
+	})
+	router.POST("/login/start", api.HandleLogin)
+	router.GET("/channels", api.HandleAuthentication, func(c *gin.Context) {
+		channels, all, err := api.ReadableChannels(c)
+		if err != nil {
+			panic(err)
+		}
+		c.JSON(http.StatusOK, gin.H{"channels": channels, "all": all})
+	})
+	return router
+}
+
+// postLogin posts the login form with the cookies of a session.
+func postLogin(router *gin.Engine, cookies []*http.Cookie, form url.Values) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/login/start", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for _, c := range cookies {
+		r.AddCookie(c)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	return w
+}
+
+func TestLocalLogin(t *testing.T) {
+	router := localRouter(t)
+
+	// openLogin opens the login page, returning the cookies of the session and the token of its form.
+	openLogin := func() ([]*http.Cookie, string) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/login", nil))
+		return sessionCookies(w), w.Body.String()
+	}
+
+	forms := []struct {
+		name  string
+		token func(token string) string
+	}{
+		{"no token", func(string) string { return "" }},
+		{"forged token", func(string) string { return "forged" }},
+	}
+	for _, form := range forms {
+		t.Run(form.name, func(t *testing.T) {
+			cookies, token := openLogin()
+			w := postLogin(router, cookies, url.Values{"username": {"alice"}, "password": {"password"}, "login_token": {form.token(token)}})
+			if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), ErrLoginForm.Error()) {
+				t.Errorf("responded %d: %s", w.Code, w.Body)
+			}
+		})
+	}
+
+	t.Run("another session", func(t *testing.T) {
+		_, token := openLogin()
+		w := postLogin(router, nil, url.Values{"username": {"alice"}, "password": {"password"}, "login_token": {token}})
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("responded %d: %s", w.Code, w.Body)
+		}
+	})
+
+	t.Run("wrong password", func(t *testing.T) {
+		cookies, token := openLogin()
+		w := postLogin(router, cookies, url.Values{"username": {"alice"}, "password": {"guess"}, "login_token": {token}})
+		if w.Code != http.StatusForbidden {
+			t.Errorf("responded %d: %s", w.Code, w.Body)
+		}
+		// The token cannot be used again, by a browser that keeps the session it was given.
+		w = postLogin(router, sessionCookies(w), url.Values{"username": {"alice"}, "password": {"password"}, "login_token": {token}})
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("reusing the token responded %d", w.Code)
+		}
+	})
+
+	t.Run("success", func(t *testing.T) {
+		cookies, token := openLogin()
+		w := postLogin(router, cookies, url.Values{"username": {"alice"}, "password": {"password"}, "login_token": {token}})
+		if w.Code != http.StatusFound || w.Header().Get("Location") != "/" {
+			t.Fatalf("responded %d: %s", w.Code, w.Body)
+		}
+		r := httptest.NewRequest(http.MethodGet, "/channels", nil)
+		for _, c := range sessionCookies(w) {
+			r.AddCookie(c)
+		}
+		channels := httptest.NewRecorder()
+		router.ServeHTTP(channels, r)
+		if body := strings.TrimSpace(channels.Body.String()); body != `{"all":false,"channels":["C1"]}` {
+			t.Errorf("can read %s", body)
+		}
+	})
+}
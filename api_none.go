@@ -2,9 +2,9 @@ package pecan
 
 import (
 	"context"
-	"encoding/json"
 	"github.com/gin-gonic/gin"
 	"github.com/olivere/elastic/v7"
+	"net/http"
 	"strconv"
 	"strings"
 	"time"
@@ -22,17 +22,12 @@ func (api *NoChatAPI) ConvertSearchResponseToMessages(resp *elastic.SearchResult
 	}
 	messages := make([]Message, len(resp.Hits.Hits))
 	for i, hit := range resp.Hits.Hits {
-		b, err := hit.Source.MarshalJSON()
-		if err != nil {
-			return nil, err
-		}
-		var msg Message
-		msg.Id = hit.Id
-		err = json.Unmarshal(b, &msg)
+		msg, err := decodeMessage(hit.Source)
 		msg.ChannelName = msg.Channel // No human-readable channel name available.
 		if err != nil {
 			return nil, err
 		}
+		msg.Id = hit.Id
 		// Parse the timestamp into something more readable.
 		t := strings.Split(msg.EventTimestamp, ".")
 		sec, err := strconv.Atoi(t[0])
@@ -46,6 +41,12 @@ func (api *NoChatAPI) ConvertSearchResponseToMessages(resp *elastic.SearchResult
 
 		msg.EventTimestamp = time.Unix(int64(sec), int64(nsec)).Format(time.RFC822)
 
+		if fragments, ok := hit.Highlight["text"]; ok {
+			msg.Highlight = fragments
+		}
+
+		msg.Sort = hit.Sort
+
 		messages[i] = msg
 		if hit.Score != nil { // Check if it is nil to prevent nil pointer dereference.
 			messages[i].Score = *hit.Score
@@ -63,6 +64,33 @@ func (api *NoChatAPI) GetMessages(es *elastic.Client, ctx context.Context, reque
 	return api.ConvertSearchResponseToMessages(resp)
 }
 
+func (api *NoChatAPI) GetFacets(es *elastic.Client, ctx context.Context, request SearchRequest) (Facets, error) {
+	resp, err := queryFacets(es, ctx, nil, request)
+	if err != nil {
+		return Facets{}, err
+	}
+	return convertSearchResponseToFacets(resp), nil
+}
+
+// CanReadChannel allows every channel to be read, since there is no authentication.
+func (api *NoChatAPI) CanReadChannel(c *gin.Context, channel string) (bool, error) {
+	return true, nil
+}
+
+// ReadableChannels allows every channel to be read, since there is no authentication.
+func (api *NoChatAPI) ReadableChannels(c *gin.Context) ([]string, bool, error) {
+	return nil, true, nil
+}
+
+// UserID is empty, since there is no authentication.
+func (api *NoChatAPI) UserID(c *gin.Context) (string, error) {
+	return "", nil
+}
+
+func (api *NoChatAPI) HandleLogin(c *gin.Context) {
+	c.Redirect(http.StatusFound, "/")
+}
+
 func (api *NoChatAPI) HandleOAuth(c *gin.Context) {
 	return
 }
@@ -71,6 +99,10 @@ func (api *NoChatAPI) HandleAuthentication(c *gin.Context) {
 	return
 }
 
+func (api *NoChatAPI) HandleLogout(c *gin.Context) {
+	return
+}
+
 func NewNoChatAPI() *NoChatAPI {
 	return &NoChatAPI{}
 }
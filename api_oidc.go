@@ -0,0 +1,481 @@
+package pecan
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	"github.com/olivere/elastic/v7"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AllChannels grants access to every channel when it is in the channels that a claim maps to.
+const AllChannels = "*"
+
+// DefaultOIDCScopes are requested from the issuer when none are configured.
+var DefaultOIDCScopes = []string{"openid", "profile", "email"}
+
+// oidcLeeway is how far the clocks of pecan and the issuer may disagree when checking the expiry of id tokens.
+const oidcLeeway = time.Minute
+
+// oidcProvider is the part of the discovery document of an issuer that logging in needs.
+type oidcProvider struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// oidcIdentity is what the token store keeps for a logged in user: who they are and the channels they can read.
+type oidcIdentity struct {
+	Subject  string   `json:"sub"`
+	Channels []string `json:"channels"`
+}
+
+// OIDCChatAPI logs users in with any OpenID Connect issuer, and grants them the channels that the claims
+// of their id token are mapped to in the config, e.g., the groups they are in. Messages are converted as
+// NoChatAPI converts them, since there is no chat API to resolve the names of users and channels with.
+type OIDCChatAPI struct {
+	*NoChatAPI
+	issuer       string
+	clientId     string
+	clientSecret string
+	redirectURL  string
+	scopes       []string
+	access       map[string]map[string][]string
+	tokens       TokenStore
+	client       *http.Client
+
+	// provider and keys are discovered from the issuer when they are first needed. The lock is only held
+	// to read or replace them, so that a slow issuer does not hold up requests that do not need it.
+	mu       sync.Mutex
+	provider *oidcProvider
+	keys     map[string]*rsa.PublicKey
+}
+
+func NewOIDCChatAPI(config *Config, tokens TokenStore) *OIDCChatAPI {
+	return &OIDCChatAPI{
+		NoChatAPI:    NewNoChatAPI(),
+		issuer:       strings.TrimSuffix(config.API.OIDC.Issuer, "/"),
+		clientId:     config.API.OIDC.ClientId,
+		clientSecret: config.API.OIDC.ClientSecret,
+		redirectURL:  config.API.OIDC.RedirectURL,
+		scopes:       config.API.OIDC.Scopes,
+		access:       config.API.OIDC.Channels,
+		tokens:       tokens,
+		client:       &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// getJSON decodes the JSON response to a GET request.
+func (api *OIDCChatAPI) getJSON(u string, v interface{}) error {
+	resp, err := api.client.Get(u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s responded with %s", u, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// discover retrieves the endpoints of the issuer, until they have been retrieved once.
+func (api *OIDCChatAPI) discover() (*oidcProvider, error) {
+	api.mu.Lock()
+	provider := api.provider
+	api.mu.Unlock()
+	if provider != nil {
+		return provider, nil
+	}
+
+	provider = new(oidcProvider)
+	if err := api.getJSON(api.issuer+"/.well-known/openid-configuration", provider); err != nil {
+		return nil, err
+	}
+	if strings.TrimSuffix(provider.Issuer, "/") != api.issuer {
+		return nil, fmt.Errorf("discovered issuer %s does not match %s", provider.Issuer, api.issuer)
+	}
+	api.mu.Lock()
+	api.provider = provider
+	api.mu.Unlock()
+	return provider, nil
+}
+
+// key finds the public key that the issuer signs id tokens with, retrieving the keys again
+// when it is not known in case the issuer has rotated them.
+func (api *OIDCChatAPI) key(provider *oidcProvider, kid string) (*rsa.PublicKey, error) {
+	api.mu.Lock()
+	key, ok := api.keys[kid]
+	api.mu.Unlock()
+	if ok {
+		return key, nil
+	}
+
+	var jwks struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := api.getJSON(provider.JWKSURI, &jwks); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]*rsa.PublicKey)
+	for _, k := range jwks.Keys {
+		if k.Kty != "RSA" || (len(k.Use) > 0 && k.Use != "sig") {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+	api.mu.Lock()
+	api.keys = keys
+	api.mu.Unlock()
+	if key, ok := keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("the issuer has no key %q", kid)
+}
+
+// verify checks the signature, issuer, audience, expiry, and nonce of an id token, and returns its claims.
+// Only RS256 signatures, which every issuer must support, are accepted.
+func (api *OIDCChatAPI) verify(provider *oidcProvider, idToken, nonce string) (map[string]interface{}, error) {
+	parts := strings.Split(idToken, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed id token")
+	}
+	b, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, err
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := json.Unmarshal(b, &header); err != nil {
+		return nil, err
+	}
+	if header.Alg != "RS256" {
+		return nil, fmt.Errorf("id token is signed with %s rather than RS256", header.Alg)
+	}
+	key, err := api.key(provider, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature); err != nil {
+		return nil, errors.New("id token signature is invalid")
+	}
+
+	b, err = base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, err
+	}
+	var claims map[string]interface{}
+	if err := json.Unmarshal(b, &claims); err != nil {
+		return nil, err
+	}
+	if iss, _ := claims["iss"].(string); strings.TrimSuffix(iss, "/") != api.issuer {
+		return nil, errors.New("id token is from another issuer")
+	}
+	if !containsString(claimValues(claims["aud"]), api.clientId) {
+		return nil, errors.New("id token is for another client")
+	}
+	exp, _ := claims["exp"].(float64)
+	if time.Now().After(time.Unix(int64(exp), 0).Add(oidcLeeway)) {
+		return nil, errors.New("id token has expired")
+	}
+	if n, _ := claims["nonce"].(string); len(nonce) == 0 || subtle.ConstantTimeCompare([]byte(n), []byte(nonce)) != 1 {
+		return nil, errors.New("id token is for another login")
+	}
+	if sub, _ := claims["sub"].(string); len(sub) == 0 {
+		return nil, errors.New("id token does not identify a user")
+	}
+	return claims, nil
+}
+
+// claimValues turns a claim, which may be a single value or a list of them, into strings.
+func claimValues(claim interface{}) []string {
+	switch v := claim.(type) {
+	case nil:
+		return nil
+	case string:
+		return []string{v}
+	case []interface{}:
+		var values []string
+		for _, item := range v {
+			values = append(values, claimValues(item)...)
+		}
+		return values
+	default:
+		return []string{fmt.Sprint(v)}
+	}
+}
+
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// channels maps the claims of a user to the channels they can read.
+func (api *OIDCChatAPI) channels(claims map[string]interface{}) []string {
+	var channels []string
+	seen := make(map[string]bool)
+	for claim, values := range api.access {
+		for _, value := range claimValues(claims[claim]) {
+			for _, channel := range values[value] {
+				if !seen[channel] {
+					seen[channel] = true
+					channels = append(channels, channel)
+				}
+			}
+		}
+	}
+	return channels
+}
+
+// identity is the logged in user of a request.
+func (api *OIDCChatAPI) identity(c *gin.Context) (oidcIdentity, error) {
+	var identity oidcIdentity
+	token, _ := sessions.Default(c).Get("token").(string)
+	if len(token) == 0 {
+		return identity, ErrTokenNotFound
+	}
+	stored, err := api.tokens.Get(token)
+	if err != nil {
+		return identity, err
+	}
+	err = json.Unmarshal([]byte(stored), &identity)
+	return identity, err
+}
+
+// UserID is the subject of the logged in user, which the issuer never reassigns.
+func (api *OIDCChatAPI) UserID(c *gin.Context) (string, error) {
+	identity, err := api.identity(c)
+	return identity.Subject, err
+}
+
+// ReadableChannels are the channels that the claims of the logged in user map to.
+func (api *OIDCChatAPI) ReadableChannels(c *gin.Context) ([]string, bool, error) {
+	identity, err := api.identity(c)
+	if err != nil {
+		return nil, false, err
+	}
+	if containsString(identity.Channels, AllChannels) {
+		return nil, true, nil
+	}
+	return identity.Channels, false, nil
+}
+
+func (api *OIDCChatAPI) GetMessages(es *elastic.Client, ctx context.Context, request SearchRequest) ([]Message, error) {
+	channels, all, err := api.ReadableChannels(request.Context)
+	if err != nil || (!all && len(channels) == 0) {
+		return []Message{}, err
+	}
+	resp, err := queryMessages(es, ctx, channels, request)
+	if err != nil {
+		return nil, err
+	}
+	return api.ConvertSearchResponseToMessages(resp)
+}
+
+func (api *OIDCChatAPI) GetFacets(es *elastic.Client, ctx context.Context, request SearchRequest) (Facets, error) {
+	channels, all, err := api.ReadableChannels(request.Context)
+	if err != nil || (!all && len(channels) == 0) {
+		return Facets{}, err
+	}
+	resp, err := queryFacets(es, ctx, channels, request)
+	if err != nil {
+		return Facets{}, err
+	}
+	return convertSearchResponseToFacets(resp), nil
+}
+
+// CanReadChannel checks whether the claims of the logged in user map to the channel.
+func (api *OIDCChatAPI) CanReadChannel(c *gin.Context, channel string) (bool, error) {
+	channels, all, err := api.ReadableChannels(c)
+	if err != nil {
+		return false, err
+	}
+	return all || containsString(channels, channel), nil
+}
+
+// HandleLogin redirects users to the issuer to log in using PKCE, with a state and nonce that HandleOAuth checks.
+func (api *OIDCChatAPI) HandleLogin(c *gin.Context) {
+	provider, err := api.discover()
+	if err != nil {
+		ErrorPage(c, http.StatusBadGateway, "Login Failed", "The login provider could not be reached: "+err.Error()+".")
+		return
+	}
+	state, nonce, verifier := randState(), randState(), randState()
+	session := sessions.Default(c)
+	session.Set("oauth_state", state)
+	session.Set("oauth_nonce", nonce)
+	session.Set("oauth_verifier", verifier)
+	if err := session.Save(); err != nil {
+		panic(err)
+	}
+
+	scopes := api.scopes
+	if len(scopes) == 0 {
+		scopes = DefaultOIDCScopes
+	}
+	challenge := sha256.Sum256([]byte(verifier))
+	params := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {api.clientId},
+		"redirect_uri":          {api.redirectURL},
+		"scope":                 {strings.Join(scopes, " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	separator := "?"
+	if strings.Contains(provider.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	c.Redirect(http.StatusFound, provider.AuthorizationEndpoint+separator+params.Encode())
+}
+
+// exchange exchanges a code for an id token at the token endpoint of the issuer.
+func (api *OIDCChatAPI) exchange(provider *oidcProvider, code, verifier string) (string, error) {
+	params := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {api.redirectURL},
+		"client_id":     {api.clientId},
+		"code_verifier": {verifier},
+	}
+	if len(api.clientSecret) > 0 {
+		params.Set("client_secret", api.clientSecret)
+	}
+	resp, err := api.client.PostForm(provider.TokenEndpoint, params)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var token struct {
+		IdToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", err
+	}
+	if len(token.Error) > 0 {
+		return "", fmt.Errorf("%s %s", token.Error, token.ErrorDescription)
+	}
+	if len(token.IdToken) == 0 {
+		return "", errors.New("no id token was issued")
+	}
+	return token.IdToken, nil
+}
+
+// HandleOAuth completes a login that HandleLogin started, once the issuer redirects users back.
+func (api *OIDCChatAPI) HandleOAuth(c *gin.Context) {
+	session := sessions.Default(c)
+	state, _ := session.Get("oauth_state").(string)
+	nonce, _ := session.Get("oauth_nonce").(string)
+	verifier, _ := session.Get("oauth_verifier").(string)
+	// The state may only be used once.
+	session.Delete("oauth_state")
+	session.Delete("oauth_nonce")
+	session.Delete("oauth_verifier")
+	if err := session.Save(); err != nil {
+		panic(err)
+	}
+
+	if reason := c.Query("error"); len(reason) > 0 {
+		ErrorPage(c, http.StatusForbidden, "Login Failed", "The login provider did not log you in: "+reason+".")
+		return
+	}
+	if len(state) == 0 || subtle.ConstantTimeCompare([]byte(state), []byte(c.Query("state"))) != 1 {
+		ErrorPage(c, http.StatusBadRequest, "Login Failed", "Please log in again, "+ErrOAuthState.Error()+".")
+		return
+	}
+
+	provider, err := api.discover()
+	if err != nil {
+		ErrorPage(c, http.StatusBadGateway, "Login Failed", "The login provider could not be reached: "+err.Error()+".")
+		return
+	}
+	idToken, err := api.exchange(provider, c.Query("code"), verifier)
+	if err != nil {
+		ErrorPage(c, http.StatusBadGateway, "Login Failed", "The login provider could not log you in: "+err.Error()+".")
+		return
+	}
+	claims, err := api.verify(provider, idToken, nonce)
+	if err != nil {
+		ErrorPage(c, http.StatusForbidden, "Login Failed", "Your identity could not be verified: "+err.Error()+".")
+		return
+	}
+	identity := oidcIdentity{Channels: api.channels(claims)}
+	identity.Subject, _ = claims["sub"].(string)
+	if len(identity.Channels) == 0 {
+		ErrorPage(c, http.StatusForbidden, "Login Failed", "You do not have access to any channels.")
+		return
+	}
+
+	b, err := json.Marshal(identity)
+	if err != nil {
+		panic(err)
+	}
+	token := randState()
+	if err := api.tokens.Put(token, string(b)); err != nil {
+		panic(err)
+	}
+	session.Set("token", token)
+	if err := session.Save(); err != nil {
+		panic(err)
+	}
+	c.Redirect(http.StatusFound, "/")
+}
+
+func (api *OIDCChatAPI) HandleAuthentication(c *gin.Context) {
+	if _, err := api.identity(c); err != nil {
+		RequireLogin(c)
+	}
+}
+
+// HandleLogout forgets the logged in user.
+func (api *OIDCChatAPI) HandleLogout(c *gin.Context) {
+	token, _ := sessions.Default(c).Get("token").(string)
+	if len(token) == 0 {
+		return
+	}
+	if err := api.tokens.Revoke(token); err != nil {
+		panic(err)
+	}
+}
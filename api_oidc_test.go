@@ -0,0 +1,238 @@
+package pecan
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-contrib/sessions/cookie"
+	"github.com/gin-gonic/gin"
+	"html/template"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeIssuer is an OpenID Connect issuer that signs id tokens with a generated key. The claims of the next
+// id token it issues, and the key it signs it with, can be changed to test how they are verified.
+type fakeIssuer struct {
+	sync.Mutex
+	*httptest.Server
+	key         *rsa.PrivateKey
+	discoveries int
+
+	// challenge and nonce are those of the login in progress.
+	challenge string
+	nonce     string
+	// claims modifies the claims of the next id token, and signer signs it instead of key when it is set.
+	claims func(claims map[string]interface{})
+	signer *rsa.PrivateKey
+}
+
+func newFakeIssuer(t *testing.T) *fakeIssuer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer := &fakeIssuer{key: key}
+	issuer.Server = httptest.NewServer(issuer)
+	return issuer
+}
+
+// expect starts a login with the parameters sent to the authorization endpoint,
+// issuing the next id token with claims and signer.
+func (f *fakeIssuer) expect(params url.Values, claims func(map[string]interface{}), signer *rsa.PrivateKey) {
+	f.Lock()
+	defer f.Unlock()
+	f.challenge, f.nonce = params.Get("code_challenge"), params.Get("nonce")
+	f.claims, f.signer = claims, signer
+}
+
+// sign creates an RS256 id token.
+func (f *fakeIssuer) sign(claims map[string]interface{}, key *rsa.PrivateKey) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "k1"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		panic(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func (f *fakeIssuer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	switch r.URL.Path {
+	case "/.well-known/openid-configuration":
+		f.discoveries++
+		_ = json.NewEncoder(w).Encode(oidcProvider{
+			Issuer:                f.URL,
+			AuthorizationEndpoint: f.URL + "/authorize",
+			TokenEndpoint:         f.URL + "/token",
+			JWKSURI:               f.URL + "/jwks",
+		})
+	case "/jwks":
+		fmt.Fprintf(w, `{"keys":[{"kty":"RSA","kid":"k1","use":"sig","n":%q,"e":%q}]}`,
+			base64.RawURLEncoding.EncodeToString(f.key.N.Bytes()),
+			base64.RawURLEncoding.EncodeToString(big.NewInt(int64(f.key.E)).Bytes()))
+	case "/token":
+		_ = r.ParseForm()
+		verifier := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+		if r.PostForm.Get("grant_type") != "authorization_code" || base64.RawURLEncoding.EncodeToString(verifier[:]) != f.challenge {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"error":"invalid_grant","error_description":"the code verifier does not match"}`)
+			return
+		}
+		claims := map[string]interface{}{
+			"iss":    f.URL,
+			"aud":    r.PostForm.Get("client_id"),
+			"sub":    "alice",
+			"nonce":  f.nonce,
+			"exp":    time.Now().Add(time.Hour).Unix(),
+			"groups": []string{"staff", "visitors"},
+		}
+		if f.claims != nil {
+			f.claims(claims)
+		}
+		signer := f.key
+		if f.signer != nil {
+			signer = f.signer
+		}
+		fmt.Fprintf(w, `{"id_token":%q}`, f.sign(claims, signer))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// oidcRouter serves the login routes of an OIDC chat API, and the channels that the logged in user can read.
+func oidcRouter(issuer string) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	config := new(Config)
+	config.API.OIDC.Issuer = issuer
+	config.API.OIDC.ClientId = "pecan"
+	config.API.OIDC.RedirectURL = "http://pecan/oauth"
+	config.API.OIDC.Channels = map[string]map[string][]string{
+		"groups": {"staff": {"C1", "C2"}, "visitors": {"C2", "C3"}},
+		"sub":    {"root": {AllChannels}},
+	}
+	api := NewOIDCChatAPI(config, NewMemoryTokenStore(0))
+
+	router := gin.New()
+	router.SetHTMLTemplate(template.Must(template.New("error.html").Parse("{{ .Title }}: {{ .Message }}")))
+	router.Use(sessions.Sessions("pecan", cookie.NewStore([]byte("secret"))))
+	router.GET("/login", api.HandleLogin)
+	router.GET("/oauth", api.HandleOAuth)
+	router.GET("/channels", api.HandleAuthentication, func(c *gin.Context) {
+		channels, all, err := api.ReadableChannels(c)
+		if err != nil {
+			panic(err)
+		}
+		sort.Strings(channels)
+		c.JSON(http.StatusOK, gin.H{"channels": channels, "all": all})
+	})
+	return router
+}
+
+func TestOIDCLogin(t *testing.T) {
+	issuer := newFakeIssuer(t)
+	defer issuer.Close()
+	router := oidcRouter(issuer.URL)
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// login logs in with the id token that claims and signer make, returning the response and the channels of the user.
+	login := func(t *testing.T, claims func(map[string]interface{}), signer *rsa.PrivateKey) (*httptest.ResponseRecorder, string) {
+		cookies, params := startLogin(t, router)
+		if params.Get("code_challenge_method") != "S256" || len(params.Get("code_challenge")) == 0 {
+			t.Errorf("login does not use PKCE: %v", params)
+		}
+		if params.Get("client_id") != "pecan" || params.Get("redirect_uri") != "http://pecan/oauth" {
+			t.Errorf("login is for another client: %v", params)
+		}
+		issuer.expect(params, claims, signer)
+		w := finishLogin(router, cookies, url.Values{"state": {params.Get("state")}, "code": {"code"}})
+		if w.Code != http.StatusFound {
+			return w, ""
+		}
+		r := httptest.NewRequest(http.MethodGet, "/channels", nil)
+		for _, c := range sessionCookies(w) {
+			r.AddCookie(c)
+		}
+		channels := httptest.NewRecorder()
+		router.ServeHTTP(channels, r)
+		return w, strings.TrimSpace(channels.Body.String())
+	}
+
+	t.Run("claims map to channels", func(t *testing.T) {
+		w, channels := login(t, nil, nil)
+		if w.Code != http.StatusFound || w.Header().Get("Location") != "/" {
+			t.Fatalf("responded %d: %s", w.Code, w.Body)
+		}
+		if channels != `{"all":false,"channels":["C1","C2","C3"]}` {
+			t.Errorf("can read %s", channels)
+		}
+	})
+
+	t.Run("all channels", func(t *testing.T) {
+		_, channels := login(t, func(claims map[string]interface{}) {
+			claims["sub"] = "root"
+			delete(claims, "groups")
+		}, nil)
+		if channels != `{"all":true,"channels":null}` {
+			t.Errorf("can read %s", channels)
+		}
+	})
+
+	rejections := []struct {
+		name   string
+		claims func(map[string]interface{})
+		signer *rsa.PrivateKey
+		reason string
+	}{
+		{"signature", nil, other, "signature is invalid"},
+		{"issuer", func(claims map[string]interface{}) { claims["iss"] = "https://elsewhere" }, nil, "another issuer"},
+		{"audience", func(claims map[string]interface{}) { claims["aud"] = []string{"other"} }, nil, "another client"},
+		{"nonce", func(claims map[string]interface{}) { claims["nonce"] = "replayed" }, nil, "another login"},
+		{"expiry", func(claims map[string]interface{}) { claims["exp"] = time.Now().Add(-time.Hour).Unix() }, nil, "expired"},
+		{"no channels", func(claims map[string]interface{}) { claims["groups"] = "guests" }, nil, "any channels"},
+	}
+	for _, rejection := range rejections {
+		t.Run(rejection.name, func(t *testing.T) {
+			w, _ := login(t, rejection.claims, rejection.signer)
+			if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), rejection.reason) {
+				t.Errorf("responded %d: %s", w.Code, w.Body)
+			}
+		})
+	}
+
+	t.Run("code verifier", func(t *testing.T) {
+		cookies, params := startLogin(t, router)
+		params.Set("code_challenge", "not-the-challenge")
+		issuer.expect(params, nil, nil)
+		w := finishLogin(router, cookies, url.Values{"state": {params.Get("state")}, "code": {"code"}})
+		if w.Code != http.StatusBadGateway || !strings.Contains(w.Body.String(), "invalid_grant") {
+			t.Errorf("responded %d: %s", w.Code, w.Body)
+		}
+	})
+
+	issuer.Lock()
+	defer issuer.Unlock()
+	if issuer.discoveries != 1 {
+		t.Errorf("discovered the issuer %d times", issuer.discoveries)
+	}
+}
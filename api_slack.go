@@ -2,28 +2,41 @@ package pecan
 
 import (
 	"context"
-	"encoding/base64"
-	"encoding/json"
 	"github.com/gin-contrib/sessions"
 	"github.com/gin-gonic/gin"
 	"github.com/olivere/elastic/v7"
 	"github.com/patrickmn/go-cache"
 	"github.com/slack-go/slack"
-	"math/rand"
 	"net/http"
 	"strconv"
 	"strings"
 	"time"
 )
 
+// SlackChatAPI searches the messages of the slack channels that the authenticated user is a member of.
+// Requests on behalf of a user are made with a client for their own access token, while the names of users
+// and channels, which are shared between users, are resolved with the bot token from the config.
 type SlackChatAPI struct {
-	client       *slack.Client
+	bot          *slack.Client
+	options      []slack.Option
+	client       *http.Client
+	url          string
 	clientId     string
 	clientSecret string
-	userCache    map[string]string
-	channelCache map[string]string
-	tokens       map[string]string
+	scopes       []string
+	openID       bool
+	redirectURL  string
+	teamId       string
+	userCache    *cache.Cache
+	channelCache *cache.Cache
+	tokens       TokenStore
 	idsCache     *cache.Cache
+	userIdCache  *cache.Cache
+}
+
+// userClient creates a slack client that makes requests with the access token of a user.
+func (api *SlackChatAPI) userClient(accessToken string) *slack.Client {
+	return slack.New(accessToken, api.options...)
 }
 
 // searchResponseToMessagesUsingAPI maps responses from elasticsearch into slack messages
@@ -31,16 +44,11 @@ type SlackChatAPI struct {
 func (api *SlackChatAPI) ConvertSearchResponseToMessages(resp *elastic.SearchResult) ([]Message, error) {
 	messages := make([]Message, len(resp.Hits.Hits))
 	for i, hit := range resp.Hits.Hits {
-		b, err := resp.Hits.Hits[i].Source.MarshalJSON()
-		if err != nil {
-			return nil, err
-		}
-
-		var msg Message
-		err = json.Unmarshal(b, &msg)
+		msg, err := decodeMessage(hit.Source)
 		if err != nil {
 			return nil, err
 		}
+		msg.Id = hit.Id
 
 		// Grab the username from the API and assign it to the message.
 		if len(msg.User) > 0 {
@@ -87,6 +95,12 @@ func (api *SlackChatAPI) ConvertSearchResponseToMessages(resp *elastic.SearchRes
 
 		msg.EventTimestamp = time.Unix(int64(sec), int64(nsec)).Format(time.RFC822)
 
+		if fragments, ok := hit.Highlight["text"]; ok {
+			msg.Highlight = fragments
+		}
+
+		msg.Sort = hit.Sort
+
 		messages[i] = msg
 		if hit.Score != nil { // Check if it is nil to prevent nil pointer dereference.
 			messages[i].Score = *hit.Score
@@ -98,37 +112,31 @@ func (api *SlackChatAPI) ConvertSearchResponseToMessages(resp *elastic.SearchRes
 
 // LookupUsernameByID retrieves the username for a slack user by their internal slack id.
 func (api *SlackChatAPI) LookupUsernameByID(id string) (string, error) {
-	if api.userCache == nil {
-		api.userCache = make(map[string]string)
+	if name, ok := api.userCache.Get(id); ok {
+		return name.(string), nil
 	}
-	if name, ok := api.userCache[id]; ok {
-		return name, nil
-	}
-	u, err := api.client.GetUserInfo(id)
+	u, err := api.bot.GetUserInfo(id)
 	if err != nil {
 		return id, nil
 	}
-	api.userCache[id] = u.Name
+	api.userCache.SetDefault(id, u.Name)
 	return u.Name, nil
 }
 
 // LookupGroupNameByID retrieves the group name for a slack group by its internal slack id.
 func (api *SlackChatAPI) LookupGroupNameByID(id string) (string, error) {
-	if api.channelCache == nil {
-		api.channelCache = make(map[string]string)
-	}
-	if name, ok := api.channelCache[id]; ok {
-		return name, nil
+	if name, ok := api.channelCache.Get(id); ok {
+		return name.(string), nil
 	}
 
 	// TODO Looks like this function is superseded by the one below? Need to double check.
-	//g, err := api.client.GetGroupInfo(id)
+	//g, err := api.bot.GetGroupInfo(id)
 	//if err == nil {
 	//	api.channelCache[id] = g.Name
 	//	return g.Name, nil
 	//}
 
-	c, err := api.client.GetConversationInfo(id, true)
+	c, err := api.bot.GetConversationInfo(id, true)
 	if err == nil {
 		n := c.Name
 		if len(c.Name) == 0 {
@@ -138,7 +146,7 @@ func (api *SlackChatAPI) LookupGroupNameByID(id string) (string, error) {
 			}
 		}
 
-		api.channelCache[id] = n
+		api.channelCache.SetDefault(id, n)
 		return n, nil
 	}
 
@@ -151,27 +159,36 @@ func (api *SlackChatAPI) LookupGroupNameByID(id string) (string, error) {
 }
 
 // GetChannelsForUser retrieves the channels the user has permission to access.
+// The names of the channels are remembered, so that private channels the bot is not in can still be named.
 func (api *SlackChatAPI) GetChannelsForUser(accessToken string) ([]string, error) {
 	// Get the ids from a cache if they already exist.
-	if api.idsCache == nil {
-		api.idsCache = cache.New(5*time.Minute, 10*time.Minute)
-	}
 	if v, ok := api.idsCache.Get(accessToken); ok {
 		return v.([]string), nil
 	}
 
-	api.client = slack.New(accessToken)
+	client := api.userClient(accessToken)
+	params := &slack.GetConversationsForUserParameters{}
+	if userId := strings.TrimPrefix(accessToken, openIDPrefix); userId != accessToken {
+		// Users who signed in with slack have no token that can read channels, so the bot lists them instead.
+		client = api.bot
+		params.UserID = userId
+	}
 	// Private groups user has access to.
-	groups, err := api.client.GetUserGroups()
+	groups, err := client.GetUserGroups()
 	if err != nil {
 		return nil, err
 	}
 
 	// Public conversations for all users.
-	conversations, _, err := api.client.GetConversationsForUser(&slack.GetConversationsForUserParameters{})
+	conversations, _, err := client.GetConversationsForUser(params)
 	if err != nil {
 		return nil, err
 	}
+	for _, conversation := range conversations {
+		if len(conversation.Name) > 0 {
+			api.channelCache.SetDefault(conversation.ID, conversation.Name)
+		}
+	}
 
 	ids := make([]string, len(groups)+len(conversations))
 	for i := range groups {
@@ -195,14 +212,17 @@ func (api *SlackChatAPI) GetChannelsForUser(accessToken string) ([]string, error
 // GetMessages uses the slack API to retrieve the channels an authenticated user has access to
 // and then retrieves messages from these channels using a search request.
 func (api *SlackChatAPI) GetMessages(es *elastic.Client, ctx context.Context, request SearchRequest) ([]Message, error) {
-	session := sessions.Default(request.Context)
-	token := api.tokens[session.Get("token").(string)]
-
-	channels, err := api.GetChannelsForUser(token)
+	token, err := api.accessToken(request.Context)
 	if err != nil {
 		return nil, err
 	}
 
+	channels, err := api.GetChannelsForUser(token)
+	if err != nil || len(channels) == 0 {
+		// Searching no channels would otherwise search all of them.
+		return []Message{}, err
+	}
+
 	resp, err := queryMessages(es, ctx, channels, request)
 	if err != nil {
 		return nil, err
@@ -210,60 +230,146 @@ func (api *SlackChatAPI) GetMessages(es *elastic.Client, ctx context.Context, re
 	return api.ConvertSearchResponseToMessages(resp)
 }
 
-func randState() string {
-	b := make([]byte, 32)
-	rand.Read(b)
-	return base64.StdEncoding.EncodeToString(b)
+// GetFacets computes facets over the channels an authenticated user has access to,
+// resolving the channel and user ids of the facets into names using the slack API.
+func (api *SlackChatAPI) GetFacets(es *elastic.Client, ctx context.Context, request SearchRequest) (Facets, error) {
+	token, err := api.accessToken(request.Context)
+	if err != nil {
+		return Facets{}, err
+	}
+
+	channels, err := api.GetChannelsForUser(token)
+	if err != nil || len(channels) == 0 {
+		return Facets{}, err
+	}
+
+	resp, err := queryFacets(es, ctx, channels, request)
+	if err != nil {
+		return Facets{}, err
+	}
+	facets := convertSearchResponseToFacets(resp)
+	for i := range facets.Channels {
+		facets.Channels[i].Name, err = api.LookupGroupNameByID(facets.Channels[i].Value)
+		if err != nil {
+			return Facets{}, err
+		}
+	}
+	for i := range facets.Users {
+		facets.Users[i].Name, err = api.LookupUsernameByID(facets.Users[i].Value)
+		if err != nil {
+			return Facets{}, err
+		}
+	}
+	return facets, nil
 }
 
-func (api *SlackChatAPI) HandleOAuth(c *gin.Context) {
-	code := c.Query("code")
-	accessToken, _, err := slack.GetOAuthToken(&http.Client{}, api.clientId, api.clientSecret, code, "")
+// ReadableChannels are the channels the authenticated user is a member of.
+func (api *SlackChatAPI) ReadableChannels(c *gin.Context) ([]string, bool, error) {
+	token, err := api.accessToken(c)
 	if err != nil {
-		panic(err)
+		return nil, false, err
 	}
-	session := sessions.Default(c)
-	token := randState()
-	api.tokens[token] = accessToken
-	session.Set("token", token)
-	err = session.Save()
+	channels, err := api.GetChannelsForUser(token)
+	return channels, false, err
+}
+
+// CanReadChannel checks whether the channel is one the authenticated user has access to.
+func (api *SlackChatAPI) CanReadChannel(c *gin.Context, channel string) (bool, error) {
+	token, err := api.accessToken(c)
 	if err != nil {
-		panic(err)
+		return false, err
 	}
 
-	c.Redirect(http.StatusFound, "/")
-	return
+	channels, err := api.GetChannelsForUser(token)
+	if err != nil {
+		return false, err
+	}
+	for _, id := range channels {
+		if id == channel {
+			return true, nil
+		}
+	}
+	return false, nil
 }
 
-func (api *SlackChatAPI) HandleAuthentication(c *gin.Context) {
-	session := sessions.Default(c)
-	token := session.Get("token")
-	if token == nil || len(token.(string)) == 0 {
-		c.Redirect(http.StatusFound, "/login")
-		c.Abort()
-		return
+// UserID is the slack id of the authenticated user.
+func (api *SlackChatAPI) UserID(c *gin.Context) (string, error) {
+	token, err := api.accessToken(c)
+	if err != nil {
+		return "", err
+	}
+	if userId := strings.TrimPrefix(token, openIDPrefix); userId != token {
+		return userId, nil
+	}
+	if v, ok := api.userIdCache.Get(token); ok {
+		return v.(string), nil
 	}
-	if accessToken, ok := api.tokens[token.(string)]; !ok {
-		c.Redirect(http.StatusFound, "/login")
-		c.Abort()
+	resp, err := api.userClient(token).AuthTest()
+	if err != nil {
+		return "", err
+	}
+	api.userIdCache.SetDefault(token, resp.UserID)
+	return resp.UserID, nil
+}
+
+// accessToken is the slack access token of the authenticated user.
+func (api *SlackChatAPI) accessToken(c *gin.Context) (string, error) {
+	token, _ := sessions.Default(c).Get("token").(string)
+	if len(token) == 0 {
+		return "", ErrTokenNotFound
+	}
+	return api.tokens.Get(token)
+}
+
+func (api *SlackChatAPI) HandleAuthentication(c *gin.Context) {
+	if accessToken, err := api.accessToken(c); err != nil {
+		RequireLogin(c)
 		return
-	} else {
-		if _, err := slack.New(accessToken).AuthTest(); err != nil {
-			c.Redirect(http.StatusFound, "/login")
-			c.Abort()
+	} else if !strings.HasPrefix(accessToken, openIDPrefix) {
+		if _, err := api.userClient(accessToken).AuthTest(); err != nil {
+			RequireLogin(c)
 			return
 		}
 	}
 }
 
-func NewSlackChatAPI(config *Config) *SlackChatAPI {
+// HandleLogout revokes the access token of the authenticated user, both in the token store and with slack.
+func (api *SlackChatAPI) HandleLogout(c *gin.Context) {
+	token, _ := sessions.Default(c).Get("token").(string)
+	if len(token) == 0 {
+		return
+	}
+	if accessToken, err := api.tokens.Get(token); err == nil && !strings.HasPrefix(accessToken, openIDPrefix) {
+		// The token may already be invalid, in which case there is nothing to revoke.
+		_, _ = api.userClient(accessToken).SendAuthRevoke(accessToken)
+	}
+	if err := api.tokens.Revoke(token); err != nil {
+		panic(err)
+	}
+}
+
+func NewSlackChatAPI(config *Config, tokens TokenStore) *SlackChatAPI {
+	var options []slack.Option
+	url := slack.APIURL
+	if len(config.API.Slack.URL) > 0 {
+		url = config.API.Slack.URL
+		options = append(options, slack.OptionAPIURL(url))
+	}
 	return &SlackChatAPI{
-		client:       slack.New(config.API.Slack.Token),
+		bot:          slack.New(config.API.Slack.Token, options...),
+		options:      options,
+		client:       &http.Client{Timeout: 10 * time.Second},
+		url:          url,
 		clientId:     config.API.Slack.ClientId,
 		clientSecret: config.API.Slack.ClientSecret,
-		userCache:    make(map[string]string),
-		channelCache: make(map[string]string),
-		tokens:       make(map[string]string),
-		idsCache:     cache.New(cache.DefaultExpiration, cache.NoExpiration),
+		scopes:       config.API.Slack.Scopes,
+		openID:       config.API.Slack.SignInWithSlack,
+		redirectURL:  config.API.Slack.RedirectURL,
+		teamId:       config.API.Slack.TeamId,
+		userCache:    cache.New(cache.NoExpiration, cache.NoExpiration),
+		channelCache: cache.New(cache.NoExpiration, cache.NoExpiration),
+		tokens:       tokens,
+		idsCache:     cache.New(5*time.Minute, 10*time.Minute),
+		userIdCache:  cache.New(time.Hour, 2*time.Hour),
 	}
 }
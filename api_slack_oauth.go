@@ -0,0 +1,227 @@
+package pecan
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	"github.com/slack-go/slack"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Scopes requested from slack when none are configured.
+var (
+	DefaultSlackScopes       = []string{"usergroups:read", "groups:read", "channels:read", "im:read", "mpim:read"}
+	DefaultSlackOpenIDScopes = []string{"openid", "profile"}
+)
+
+const (
+	slackAuthorizeURL       = "https://slack.com/oauth/authorize"
+	slackOpenIDAuthorizeURL = "https://slack.com/openid/connect/authorize"
+	// openIDPrefix marks the users in the token store who signed in with slack, who are stored by their user id.
+	openIDPrefix = "openid:"
+)
+
+var ErrOAuthState = errors.New("the login did not start in this browser, or has already been used")
+
+// randState creates a random string that cannot be guessed, for session tokens and login nonces.
+func randState() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// HandleLogin redirects users to slack to log in, with a state that HandleOAuth checks
+// to be sure that the login was started by the same browser.
+func (api *SlackChatAPI) HandleLogin(c *gin.Context) {
+	session := sessions.Default(c)
+	state := randState()
+	session.Set("oauth_state", state)
+
+	params := url.Values{
+		"client_id": {api.clientId},
+		"state":     {state},
+	}
+	if len(api.redirectURL) > 0 {
+		params.Set("redirect_uri", api.redirectURL)
+	}
+	if len(api.teamId) > 0 {
+		params.Set("team", api.teamId)
+	}
+	scopes := api.scopes
+	authorize := slackAuthorizeURL
+	if api.openID {
+		if len(scopes) == 0 {
+			scopes = DefaultSlackOpenIDScopes
+		}
+		nonce := randState()
+		session.Set("oauth_nonce", nonce)
+		params.Set("response_type", "code")
+		params.Set("nonce", nonce)
+		params.Set("scope", strings.Join(scopes, " "))
+		authorize = slackOpenIDAuthorizeURL
+	} else {
+		if len(scopes) == 0 {
+			scopes = DefaultSlackScopes
+		}
+		params.Set("scope", strings.Join(scopes, ","))
+	}
+	if err := session.Save(); err != nil {
+		panic(err)
+	}
+	c.Redirect(http.StatusFound, authorize+"?"+params.Encode())
+}
+
+// HandleOAuth completes a login that HandleLogin started, once slack redirects users back.
+func (api *SlackChatAPI) HandleOAuth(c *gin.Context) {
+	session := sessions.Default(c)
+	state, _ := session.Get("oauth_state").(string)
+	nonce, _ := session.Get("oauth_nonce").(string)
+	// The state may only be used once.
+	session.Delete("oauth_state")
+	session.Delete("oauth_nonce")
+	if err := session.Save(); err != nil {
+		panic(err)
+	}
+
+	if reason := c.Query("error"); len(reason) > 0 {
+		ErrorPage(c, http.StatusForbidden, "Login Failed", "Slack did not log you in: "+reason+".")
+		return
+	}
+	if len(state) == 0 || subtle.ConstantTimeCompare([]byte(state), []byte(c.Query("state"))) != 1 {
+		ErrorPage(c, http.StatusBadRequest, "Login Failed", "Please log in again, "+ErrOAuthState.Error()+".")
+		return
+	}
+
+	var accessToken, team string
+	if api.openID {
+		userId, teamId, err := api.exchangeOpenID(c.Query("code"), nonce)
+		if err != nil {
+			ErrorPage(c, http.StatusBadGateway, "Login Failed", "Slack could not log you in: "+err.Error()+".")
+			return
+		}
+		accessToken, team = openIDPrefix+userId, teamId
+	} else {
+		resp, err := api.exchangeOAuth(c.Query("code"))
+		if err != nil {
+			ErrorPage(c, http.StatusBadGateway, "Login Failed", "Slack could not log you in: "+err.Error()+".")
+			return
+		}
+		accessToken, team = resp.AccessToken, resp.TeamID
+	}
+	if len(api.teamId) > 0 && team != api.teamId {
+		if !strings.HasPrefix(accessToken, openIDPrefix) {
+			// The token will never be used, so there is no reason for slack to keep it.
+			_, _ = api.userClient(accessToken).SendAuthRevoke(accessToken)
+		}
+		ErrorPage(c, http.StatusForbidden, "Login Failed", "Only members of the configured slack workspace can log in.")
+		return
+	}
+
+	token := randState()
+	if err := api.tokens.Put(token, accessToken); err != nil {
+		panic(err)
+	}
+	session.Set("token", token)
+	if err := session.Save(); err != nil {
+		panic(err)
+	}
+	c.Redirect(http.StatusFound, "/")
+}
+
+// exchangeOAuth exchanges a code for an access token. It is exchanged with the configured slack API,
+// which slack.GetOAuthResponse does not allow.
+func (api *SlackChatAPI) exchangeOAuth(code string) (*slack.OAuthResponse, error) {
+	params := url.Values{
+		"client_id":     {api.clientId},
+		"client_secret": {api.clientSecret},
+		"code":          {code},
+	}
+	if len(api.redirectURL) > 0 {
+		params.Set("redirect_uri", api.redirectURL)
+	}
+	resp, err := api.client.PostForm(api.url+"oauth.access", params)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var oauth slack.OAuthResponse
+	if err := json.NewDecoder(resp.Body).Decode(&oauth); err != nil {
+		return nil, err
+	}
+	return &oauth, oauth.Err()
+}
+
+// slackOpenIDResponse is the response of slack to exchanging a code for an OpenID Connect token.
+type slackOpenIDResponse struct {
+	Ok      bool   `json:"ok"`
+	Error   string `json:"error"`
+	IdToken string `json:"id_token"`
+}
+
+// slackIdClaims are the claims about a user in the id token of slack.
+type slackIdClaims struct {
+	Audience string `json:"aud"`
+	Subject  string `json:"sub"`
+	Nonce    string `json:"nonce"`
+	Expires  int64  `json:"exp"`
+	TeamId   string `json:"https://slack.com/team_id"`
+}
+
+// exchangeOpenID exchanges a code for an id token, and returns the user and team it identifies.
+// The signature of the token is not checked because it comes straight from slack over TLS,
+// which OpenID Connect allows in place of checking it, but its audience, nonce, and expiry are.
+func (api *SlackChatAPI) exchangeOpenID(code, nonce string) (string, string, error) {
+	params := url.Values{
+		"client_id":     {api.clientId},
+		"client_secret": {api.clientSecret},
+		"code":          {code},
+	}
+	if len(api.redirectURL) > 0 {
+		params.Set("redirect_uri", api.redirectURL)
+	}
+	resp, err := api.client.PostForm(api.url+"openid.connect.token", params)
+	if err != nil {
+		return "", "", err
+	}
+	defer resp.Body.Close()
+	var token slackOpenIDResponse
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", "", err
+	}
+	if !token.Ok {
+		return "", "", errors.New(token.Error)
+	}
+
+	parts := strings.Split(token.IdToken, ".")
+	if len(parts) != 3 {
+		return "", "", errors.New("malformed id token")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", "", err
+	}
+	var claims slackIdClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return "", "", err
+	}
+	switch {
+	case claims.Audience != api.clientId:
+		return "", "", errors.New("id token is for another client")
+	case len(nonce) == 0 || subtle.ConstantTimeCompare([]byte(claims.Nonce), []byte(nonce)) != 1:
+		return "", "", errors.New("id token is for another login")
+	case time.Now().After(time.Unix(claims.Expires, 0)):
+		return "", "", errors.New("id token has expired")
+	case len(claims.Subject) == 0:
+		return "", "", errors.New("id token does not identify a user")
+	}
+	return claims.Subject, claims.TeamId, nil
+}
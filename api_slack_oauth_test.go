@@ -0,0 +1,180 @@
+package pecan
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-contrib/sessions/cookie"
+	"github.com/gin-gonic/gin"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSlackOAuth exchanges codes for the access token or id token of a member of team,
+// and remembers the access tokens that are revoked.
+type fakeSlackOAuth struct {
+	sync.Mutex
+	team    string
+	nonce   string
+	revoked []string
+}
+
+// expect sets the team of the user that logs in next, and the nonce of their login.
+func (f *fakeSlackOAuth) expect(team, nonce string) {
+	f.Lock()
+	defer f.Unlock()
+	f.team, f.nonce = team, nonce
+}
+
+func (f *fakeSlackOAuth) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+	_ = r.ParseForm()
+	w.Header().Set("Content-Type", "application/json")
+	switch strings.TrimPrefix(r.URL.Path, "/") {
+	case "oauth.access":
+		fmt.Fprintf(w, `{"ok":true,"access_token":"xoxp-user","team_id":%q}`, f.team)
+	case "openid.connect.token":
+		claims, _ := json.Marshal(slackIdClaims{
+			Audience: r.Form.Get("client_id"),
+			Subject:  "U1",
+			Nonce:    f.nonce,
+			Expires:  time.Now().Add(time.Hour).Unix(),
+			TeamId:   f.team,
+		})
+		token := "e30." + base64.RawURLEncoding.EncodeToString(claims) + ".c2ln"
+		fmt.Fprintf(w, `{"ok":true,"id_token":%q}`, token)
+	case "auth.revoke":
+		f.revoked = append(f.revoked, r.Form.Get("token"))
+		fmt.Fprint(w, `{"ok":true,"revoked":true}`)
+	default:
+		fmt.Fprint(w, `{"ok":false,"error":"unknown_method"}`)
+	}
+}
+
+// oauthRouter serves the login routes of a slack chat API that logs users in to team T1.
+func oauthRouter(slackURL string, openID bool) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	config := new(Config)
+	config.API.Slack.URL = slackURL + "/"
+	config.API.Slack.ClientId = "client"
+	config.API.Slack.ClientSecret = "secret"
+	config.API.Slack.TeamId = "T1"
+	config.API.Slack.SignInWithSlack = openID
+	api := NewSlackChatAPI(config, NewMemoryTokenStore(0))
+
+	router := gin.New()
+	router.SetHTMLTemplate(template.Must(template.New("error.html").Parse("{{ .Title }}: {{ .Message }}")))
+	router.Use(sessions.Sessions("pecan", cookie.NewStore([]byte("secret"))))
+	router.GET("/login", api.HandleLogin)
+	router.GET("/oauth", api.HandleOAuth)
+	return router
+}
+
+// startLogin starts a login, returning the cookies of the session and the parameters sent to slack.
+func startLogin(t *testing.T, router *gin.Engine) ([]*http.Cookie, url.Values) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/login", nil))
+	if w.Code != http.StatusFound {
+		t.Fatalf("login responded %d", w.Code)
+	}
+	location, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sessionCookies(w), location.Query()
+}
+
+// sessionCookies are the cookies that a browser keeps from a response, which are the last of each name.
+func sessionCookies(w *httptest.ResponseRecorder) []*http.Cookie {
+	var cookies []*http.Cookie
+	index := make(map[string]int)
+	for _, c := range w.Result().Cookies() {
+		if i, ok := index[c.Name]; ok {
+			cookies[i] = c
+			continue
+		}
+		index[c.Name] = len(cookies)
+		cookies = append(cookies, c)
+	}
+	return cookies
+}
+
+// finishLogin returns from slack to the login with the query.
+func finishLogin(router *gin.Engine, cookies []*http.Cookie, query url.Values) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, "/oauth?"+query.Encode(), nil)
+	for _, c := range cookies {
+		r.AddCookie(c)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	return w
+}
+
+func TestSlackOAuth(t *testing.T) {
+	for _, openID := range []bool{false, true} {
+		t.Run(fmt.Sprintf("openid=%v", openID), func(t *testing.T) {
+			slack := new(fakeSlackOAuth)
+			server := httptest.NewServer(slack)
+			defer server.Close()
+			router := oauthRouter(server.URL, openID)
+
+			t.Run("state mismatch", func(t *testing.T) {
+				cookies, params := startLogin(t, router)
+				slack.expect("T1", params.Get("nonce"))
+				w := finishLogin(router, cookies, url.Values{"state": {"forged"}, "code": {"code"}})
+				if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), ErrOAuthState.Error()) {
+					t.Errorf("responded %d: %s", w.Code, w.Body)
+				}
+				// The state cannot be used once it has been tried, by a browser that keeps the session it was given.
+				w = finishLogin(router, sessionCookies(w), url.Values{"state": {params.Get("state")}, "code": {"code"}})
+				if w.Code != http.StatusBadRequest {
+					t.Errorf("reusing the state responded %d", w.Code)
+				}
+			})
+
+			t.Run("error", func(t *testing.T) {
+				cookies, params := startLogin(t, router)
+				w := finishLogin(router, cookies, url.Values{"state": {params.Get("state")}, "error": {"access_denied"}})
+				if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "access_denied") {
+					t.Errorf("responded %d: %s", w.Code, w.Body)
+				}
+			})
+
+			t.Run("team mismatch", func(t *testing.T) {
+				cookies, params := startLogin(t, router)
+				slack.expect("T2", params.Get("nonce"))
+				w := finishLogin(router, cookies, url.Values{"state": {params.Get("state")}, "code": {"code"}})
+				if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "workspace") {
+					t.Errorf("responded %d: %s", w.Code, w.Body)
+				}
+				slack.Lock()
+				revoked := slack.revoked
+				slack.Unlock()
+				if !openID && (len(revoked) != 1 || revoked[0] != "xoxp-user") {
+					t.Errorf("revoked %v, want the token of the other workspace", revoked)
+				}
+			})
+
+			t.Run("success", func(t *testing.T) {
+				cookies, params := startLogin(t, router)
+				if params.Get("team") != "T1" {
+					t.Errorf("logging in to team %q", params.Get("team"))
+				}
+				slack.expect("T1", params.Get("nonce"))
+				w := finishLogin(router, cookies, url.Values{"state": {params.Get("state")}, "code": {"code"}})
+				if w.Code != http.StatusFound || w.Header().Get("Location") != "/" {
+					t.Errorf("responded %d: %s", w.Code, w.Body)
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,134 @@
+package pecan
+
+import (
+	"context"
+	"fmt"
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-contrib/sessions/cookie"
+	"github.com/gin-gonic/gin"
+	"github.com/olivere/elastic/v7"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// slackChannels are the channels that each access token of the fake slack API is a member of.
+var slackChannels = map[string][]string{
+	"xoxp-a": {"C1", "C2"},
+	"xoxp-b": {"C3"},
+}
+
+// fakeSlack answers the methods of the slack API that SlackChatAPI uses, for the tokens in slackChannels.
+func fakeSlack(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Error(err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		switch strings.TrimPrefix(r.URL.Path, "/") {
+		case "users.conversations":
+			var channels []string
+			for _, id := range slackChannels[r.PostForm.Get("token")] {
+				channels = append(channels, fmt.Sprintf(`{"id":%q,"name":%q}`, id, strings.ToLower(id)))
+			}
+			fmt.Fprintf(w, `{"ok":true,"channels":[%s],"response_metadata":{"next_cursor":""}}`, strings.Join(channels, ","))
+		case "usergroups.list":
+			fmt.Fprint(w, `{"ok":true,"usergroups":[]}`)
+		case "users.info":
+			fmt.Fprintf(w, `{"ok":true,"user":{"id":%q,"name":"alice"}}`, r.Form.Get("user"))
+		case "conversations.info":
+			id := r.Form.Get("channel")
+			fmt.Fprintf(w, `{"ok":true,"channel":{"id":%q,"name":%q}}`, id, strings.ToLower(id))
+		default:
+			fmt.Fprint(w, `{"ok":false,"error":"unknown_method"}`)
+		}
+	}))
+}
+
+// fakeChannelSearch answers every search with a message in each of the channels the query is restricted to.
+func fakeChannelSearch() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		var hits []string
+		for _, id := range []string{"C1", "C2", "C3"} {
+			if strings.Contains(string(body), `"`+id+`"`) {
+				hits = append(hits, fmt.Sprintf(`{"_id":"m%s","_score":1,"_source":{"channel":%q,"user":"U1","text":"hello","ts":"1615256000.000100","event_ts":"1615256000.000100"}}`, id, id))
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"took":1,"hits":{"total":{"value":%d,"relation":"eq"},"hits":[%s]}}`, len(hits), strings.Join(hits, ","))
+	}))
+}
+
+// sessionContext is the context of a request from a session with a session token.
+func sessionContext(token string) *gin.Context {
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodGet, "/search", nil)
+	sessions.Sessions("pecan", cookie.NewStore([]byte("secret")))(c)
+	sessions.Default(c).Set("token", token)
+	return c
+}
+
+// TestSlackChatAPIConcurrentUsers checks, under -race, that users searching at the same time only see their own channels.
+func TestSlackChatAPIConcurrentUsers(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	slackServer := fakeSlack(t)
+	defer slackServer.Close()
+	esServer := fakeChannelSearch()
+	defer esServer.Close()
+
+	es, err := elastic.NewClient(elastic.SetURL(esServer.URL), elastic.SetSniff(false), elastic.SetHealthcheck(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := new(Config)
+	config.API.Slack.Token = "xoxb-bot"
+	config.API.Slack.URL = slackServer.URL + "/"
+	tokens := NewMemoryTokenStore(0)
+	api := NewSlackChatAPI(config, tokens)
+	for accessToken := range slackChannels {
+		if err := tokens.Put("session-"+accessToken, accessToken); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var wg sync.WaitGroup
+	for accessToken, readable := range slackChannels {
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func(accessToken string, readable []string) {
+				defer wg.Done()
+				c := sessionContext("session-" + accessToken)
+				request := SearchRequest{Query: "hello", Context: c}
+				request.SetDefaultDates()
+				messages, err := api.GetMessages(es, context.Background(), request)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if len(messages) != len(readable) {
+					t.Errorf("%s: found %d messages, want one in each of %v", accessToken, len(messages), readable)
+				}
+				for _, message := range messages {
+					if !containsString(readable, message.Channel) {
+						t.Errorf("%s: found a message in %s", accessToken, message.Channel)
+					}
+				}
+				for _, channel := range []string{"C1", "C2", "C3"} {
+					ok, err := api.CanReadChannel(c, channel)
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					if ok != containsString(readable, channel) {
+						t.Errorf("%s: CanReadChannel(%s) = %v", accessToken, channel, ok)
+					}
+				}
+			}(accessToken, readable)
+		}
+	}
+	wg.Wait()
+}
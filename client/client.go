@@ -0,0 +1,257 @@
+// Package client is a Go client for the JSON API of a pecan server, as described by /api/openapi.json.
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/hscells/trecresults"
+	"github.com/ielab/pecan"
+	"github.com/ielab/pecan/addon"
+	"github.com/ielab/pecan/eval"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Client makes requests to the API of a pecan server.
+type Client struct {
+	baseURL    string
+	httpClient *http.Client
+	header     http.Header
+}
+
+// Option configures a client.
+type Option func(c *Client)
+
+// WithHTTPClient uses the http client to make requests, e.g., one with a cookie jar holding a session.
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(c *Client) {
+		c.httpClient = httpClient
+	}
+}
+
+// WithHeader sets a header on every request, e.g., a Cookie header containing a session.
+func WithHeader(key, value string) Option {
+	return func(c *Client) {
+		c.header.Set(key, value)
+	}
+}
+
+// New creates a client for the pecan server at baseURL, e.g., http://localhost:4713.
+func New(baseURL string, options ...Option) *Client {
+	c := &Client{
+		baseURL:    strings.TrimRight(baseURL, "/"),
+		httpClient: http.DefaultClient,
+		header:     make(http.Header),
+	}
+	for _, option := range options {
+		option(c)
+	}
+	return c
+}
+
+// Error is returned when the server responds with an unsuccessful status code.
+type Error struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("pecan: %d %s", e.StatusCode, e.Message)
+}
+
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, body interface{}) (*http.Response, error) {
+	u := c.baseURL + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		r = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u, r)
+	if err != nil {
+		return nil, err
+	}
+	for key := range c.header {
+		req.Header.Set(key, c.header.Get(key))
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+		var e pecan.ErrorResponse
+		if err := json.NewDecoder(resp.Body).Decode(&e); err != nil || len(e.Error) == 0 {
+			e.Error = http.StatusText(resp.StatusCode)
+		}
+		return nil, &Error{StatusCode: resp.StatusCode, Message: e.Error}
+	}
+	return resp, nil
+}
+
+func (c *Client) getJSON(ctx context.Context, path string, query url.Values, v interface{}) error {
+	resp, err := c.do(ctx, http.MethodGet, path, query, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// dateRange adds the dates of a request to query parameters when they are set.
+func dateRange(query url.Values, request pecan.SearchRequest) {
+	if !request.From.IsZero() {
+		query.Set("from", request.From.Format(pecan.DateFormat))
+	}
+	if !request.To.IsZero() {
+		query.Set("to", request.To.Format(pecan.DateFormat))
+	}
+}
+
+// Search retrieves a page of conversations for the query, dates, filters, cursor, and size of the request.
+func (c *Client) Search(ctx context.Context, request pecan.SearchRequest) (*pecan.ConversationsResponse, error) {
+	query := url.Values{}
+	query.Set("q", request.Query)
+	dateRange(query, request)
+	if len(request.Channel) > 0 {
+		query.Set("channel", request.Channel)
+	}
+	if len(request.User) > 0 {
+		query.Set("user", request.User)
+	}
+	if len(request.Cursor) > 0 {
+		query.Set("cursor", request.Cursor)
+	}
+	if request.Size > 0 {
+		query.Set("size", strconv.Itoa(request.Size))
+	}
+
+	var resp pecan.ConversationsResponse
+	err := c.getJSON(ctx, "/api/v1/search", query, &resp)
+	if err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Context retrieves the messages before (PrevNext is 0) or after (PrevNext is 1)
+// the base message of the request.
+func (c *Client) Context(ctx context.Context, request pecan.SearchRequest) (*pecan.MessagesResponse, error) {
+	query := url.Values{}
+	query.Set("base_message_time", request.BaseMessageTime)
+	query.Set("base_message_channel", request.BaseMessageChannel)
+	query.Set("prev_next", strconv.Itoa(request.PrevNext))
+	dateRange(query, request)
+
+	var resp pecan.MessagesResponse
+	err := c.getJSON(ctx, "/api/v1/messages/context", query, &resp)
+	if err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Stats retrieves statistics about the indexed messages.
+func (c *Client) Stats(ctx context.Context) (*pecan.StatisticsResponse, error) {
+	var resp pecan.StatisticsResponse
+	err := c.getJSON(ctx, "/api/v1/stats", nil, &resp)
+	if err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Channels retrieves the channels the user has access to.
+func (c *Client) Channels(ctx context.Context) ([]pecan.Facet, error) {
+	var resp pecan.ChannelsResponse
+	err := c.getJSON(ctx, "/api/v1/channels", nil, &resp)
+	return resp.Channels, err
+}
+
+// Users retrieves the users that sent messages the user has access to.
+func (c *Client) Users(ctx context.Context) ([]pecan.Facet, error) {
+	var resp pecan.UsersResponse
+	err := c.getJSON(ctx, "/api/v1/users", nil, &resp)
+	return resp.Users, err
+}
+
+// Evaluate retrieves the TREC run for a topic from the evaluation addon.
+func (c *Client) Evaluate(ctx context.Context, request addon.EvaluationRequest) (trecresults.ResultList, error) {
+	resp, err := c.do(ctx, http.MethodPost, "/addon/evaluation", nil, request)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return readRun(resp.Body)
+}
+
+// Score retrieves the run for a topic from the evaluation addon and scores it against the qrels of the request.
+func (c *Client) Score(ctx context.Context, request addon.EvaluationRequest) (*eval.Results, error) {
+	resp, err := c.do(ctx, http.MethodPost, "/addon/evaluation", nil, request)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var results eval.Results
+	if err := json.NewDecoder(resp.Body).Decode(&results); err != nil {
+		return nil, err
+	}
+	return &results, nil
+}
+
+// EvaluateBatch retrieves a TREC run for each pipeline over the topics of the request from the evaluation addon,
+// scoring the runs when the request has qrels.
+func (c *Client) EvaluateBatch(ctx context.Context, request addon.EvaluationRequest) (*addon.BatchEvaluationResponse, error) {
+	resp, err := c.do(ctx, http.MethodPost, "/addon/evaluation", nil, request)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var batch addon.BatchEvaluationResponse
+	if err := json.NewDecoder(resp.Body).Decode(&batch); err != nil {
+		return nil, err
+	}
+	return &batch, nil
+}
+
+// readRun parses a TREC run, allowing the run name to be missing.
+func readRun(r io.Reader) (trecresults.ResultList, error) {
+	var results trecresults.ResultList
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if len(strings.TrimSpace(line)) == 0 {
+			continue
+		}
+		if len(strings.Fields(line)) == 5 {
+			line += " -"
+		}
+		result, err := trecresults.ResultFromLine(line)
+		if err != nil {
+			return nil, err
+		}
+		if result.RunName == "-" {
+			result.RunName = ""
+		}
+		results = append(results, result)
+	}
+	return results, scanner.Err()
+}
@@ -0,0 +1,230 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/hscells/trecresults"
+	"github.com/ielab/pecan"
+	"github.com/ielab/pecan/addon"
+	"github.com/ielab/pecan/eval"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// recorded is a request received by the test server.
+type recorded struct {
+	method string
+	path   string
+	query  url.Values
+	header http.Header
+	body   []byte
+}
+
+// serve starts a server that responds to every request with the status and body, recording the last request.
+func serve(t *testing.T, status int, body string) (*Client, *recorded) {
+	t.Helper()
+	last := new(recorded)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		*last = recorded{method: r.Method, path: r.URL.Path, query: r.URL.Query(), header: r.Header, body: b}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte(body))
+	}))
+	t.Cleanup(server.Close)
+	return New(server.URL+"/", WithHeader("Cookie", "pecan=session")), last
+}
+
+func date(s string) time.Time {
+	t, err := time.Parse(pecan.DateFormat, s)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+func TestClientRequests(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name     string
+		response string
+		call     func(c *Client) (interface{}, error)
+		method   string
+		path     string
+		query    url.Values
+		body     string
+		want     interface{}
+	}{
+		{
+			name:     "search",
+			response: `{"query":"hello","from":"2021-01-01","to":"2021-03-01","start":10,"cursor":"c2","next":"c3","conversations":[{"score":1.5,"messages":[{"id":"m1","channel":"C1","text":"hello","hit":true}]}],"facets":{"Channels":null,"Users":null}}`,
+			call: func(c *Client) (interface{}, error) {
+				return c.Search(ctx, pecan.SearchRequest{Query: "hello", From: date("2021-01-01"), To: date("2021-03-01"), Channel: "C1", Cursor: "c2", Size: 5})
+			},
+			method: http.MethodGet,
+			path:   "/api/v1/search",
+			query:  url.Values{"q": {"hello"}, "from": {"2021-01-01"}, "to": {"2021-03-01"}, "channel": {"C1"}, "cursor": {"c2"}, "size": {"5"}},
+			want: &pecan.ConversationsResponse{
+				Query: "hello", From: "2021-01-01", To: "2021-03-01", Start: 10, Cursor: "c2", Next: "c3",
+				Conversations: []pecan.Conversation{{Score: 1.5, Messages: []pecan.Message{{Id: "m1", Channel: "C1", Text: "hello", Hit: true}}}},
+			},
+		},
+		{
+			name:     "context",
+			response: `{"channel":"C1","prev_next":1,"messages":[{"id":"m2","channel":"C1","text":"after","ts":"1615256001.000100"}]}`,
+			call: func(c *Client) (interface{}, error) {
+				return c.Context(ctx, pecan.SearchRequest{BaseMessageChannel: "C1", BaseMessageTime: "1615256000.000100", PrevNext: 1})
+			},
+			method: http.MethodGet,
+			path:   "/api/v1/messages/context",
+			query:  url.Values{"base_message_channel": {"C1"}, "base_message_time": {"1615256000.000100"}, "prev_next": {"1"}},
+			want: &pecan.MessagesResponse{
+				Channel: "C1", PrevNext: 1,
+				Messages: []pecan.Message{{Id: "m2", Channel: "C1", Text: "after", Timestamp: "1615256001.000100"}},
+			},
+		},
+		{
+			name:     "stats",
+			response: `{"num_messages":42,"from":"2010-01-01","to":"2021-03-01"}`,
+			call: func(c *Client) (interface{}, error) {
+				return c.Stats(ctx)
+			},
+			method: http.MethodGet,
+			path:   "/api/v1/stats",
+			query:  url.Values{},
+			want:   &pecan.StatisticsResponse{NumMessages: 42, From: "2010-01-01", To: "2021-03-01"},
+		},
+		{
+			name:     "evaluate",
+			response: "1 Q0 m1 1 2.5 run\n\n1 Q0 m2 2 1.5\n",
+			call: func(c *Client) (interface{}, error) {
+				request := addon.EvaluationRequest{Topic: "1", RunName: "run", Depth: 5}
+				request.Query = "hello"
+				return c.Evaluate(ctx, request)
+			},
+			method: http.MethodPost,
+			path:   "/addon/evaluation",
+			query:  url.Values{},
+			body:   `{"run_name":"run","topic":"1","depth":5,"query":"hello"}`,
+			want: trecresults.ResultList{
+				{Topic: "1", Iteration: "Q0", DocId: "m1", Rank: 1, Score: 2.5, RunName: "run"},
+				{Topic: "1", Iteration: "Q0", DocId: "m2", Rank: 2, Score: 1.5},
+			},
+		},
+		{
+			name:     "score",
+			response: `{"topics":{"1":{"ndcg@10":0.5}},"mean":{"ndcg@10":0.5}}`,
+			call: func(c *Client) (interface{}, error) {
+				request := addon.EvaluationRequest{Topic: "1", Qrels: "1 0 m1 1\n"}
+				request.Query = "hello"
+				return c.Score(ctx, request)
+			},
+			method: http.MethodPost,
+			path:   "/addon/evaluation",
+			query:  url.Values{},
+			body:   `{"topic":"1","qrels":"1 0 m1 1\n","query":"hello"}`,
+			want:   &eval.Results{Topics: map[string]eval.Measures{"1": {"ndcg@10": 0.5}}, Mean: eval.Measures{"ndcg@10": 0.5}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, last := serve(t, http.StatusOK, test.response)
+			got, err := test.call(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if last.method != test.method || last.path != test.path {
+				t.Errorf("requested %s %s, want %s %s", last.method, last.path, test.method, test.path)
+			}
+			if !reflect.DeepEqual(last.query, test.query) {
+				t.Errorf("requested with the query %v, want %v", last.query, test.query)
+			}
+			if last.header.Get("Cookie") != "pecan=session" || last.header.Get("Accept") != "application/json" {
+				t.Errorf("requested with the headers %v", last.header)
+			}
+			if len(test.body) > 0 {
+				if last.header.Get("Content-Type") != "application/json" {
+					t.Errorf("requested with the content type %q", last.header.Get("Content-Type"))
+				}
+				var gotBody, wantBody map[string]interface{}
+				if err := json.Unmarshal(last.body, &gotBody); err != nil {
+					t.Fatal(err)
+				}
+				if err := json.Unmarshal([]byte(test.body), &wantBody); err != nil {
+					t.Fatal(err)
+				}
+				for key, value := range wantBody {
+					if !reflect.DeepEqual(gotBody[key], value) {
+						t.Errorf("requested with %s = %v, want %v", key, gotBody[key], value)
+					}
+				}
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestClientErrors(t *testing.T) {
+	ctx := context.Background()
+	calls := map[string]func(c *Client) error{
+		"search": func(c *Client) error {
+			_, err := c.Search(ctx, pecan.SearchRequest{Query: "hello"})
+			return err
+		},
+		"context": func(c *Client) error {
+			_, err := c.Context(ctx, pecan.SearchRequest{BaseMessageChannel: "C2", BaseMessageTime: "1"})
+			return err
+		},
+		"stats": func(c *Client) error {
+			_, err := c.Stats(ctx)
+			return err
+		},
+		"evaluate": func(c *Client) error {
+			_, err := c.Evaluate(ctx, addon.EvaluationRequest{})
+			return err
+		},
+		"score": func(c *Client) error {
+			_, err := c.Score(ctx, addon.EvaluationRequest{})
+			return err
+		},
+	}
+	responses := []struct {
+		name    string
+		status  int
+		body    string
+		message string
+	}{
+		{"error response", http.StatusForbidden, `{"error":"you do not have access to this channel"}`, "you do not have access to this channel"},
+		{"other response", http.StatusBadGateway, `<html>bad gateway</html>`, http.StatusText(http.StatusBadGateway)},
+	}
+	for _, response := range responses {
+		for name, call := range calls {
+			t.Run(response.name+"/"+name, func(t *testing.T) {
+				c, _ := serve(t, response.status, response.body)
+				err := call(c)
+				var e *Error
+				if !errors.As(err, &e) {
+					t.Fatalf("returned %v, want an *Error", err)
+				}
+				if e.StatusCode != response.status || e.Message != response.message {
+					t.Errorf("returned %d %q, want %d %q", e.StatusCode, e.Message, response.status, response.message)
+				}
+			})
+		}
+	}
+
+	t.Run("malformed response", func(t *testing.T) {
+		c, _ := serve(t, http.StatusOK, `{"num_messages":`)
+		if _, err := c.Stats(ctx); err == nil {
+			t.Error("decoded a truncated response")
+		}
+	})
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/ielab/pecan/eval"
+	"os"
+)
+
+// compare tests whether the runs in a results file, as written by eval, differ significantly on a measure.
+func compare(args []string) error {
+	fs := flag.NewFlagSet("pecanctl compare", flag.ExitOnError)
+	resultsPath := fs.String("results", "", "path to the measures of each run, as written by pecanctl eval (required)")
+	measure := fs.String("measure", fmt.Sprintf("ndcg@%d", eval.DefaultCutoff), "measure to compare the runs on")
+	correction := fs.String("correction", eval.Holm, "correction for comparing many runs: none, bonferroni, or holm")
+	trials := fs.Int("trials", eval.DefaultTrials, "number of trials of the randomisation and bootstrap tests")
+	format := fs.String("format", "md", "output format: md or json")
+	outputPath := fs.String("output", "-", "path to write the comparison to")
+	_ = fs.Parse(args)
+
+	if len(*resultsPath) == 0 {
+		fs.Usage()
+		return fmt.Errorf("-results is required")
+	}
+	if *format != "md" && *format != "json" {
+		return fmt.Errorf("unknown format %q", *format)
+	}
+
+	b, err := os.ReadFile(*resultsPath)
+	if err != nil {
+		return err
+	}
+	var results map[string]eval.Results
+	if err := json.Unmarshal(b, &results); err != nil {
+		return err
+	}
+	table, err := eval.Compare(results, *measure, *correction, *trials)
+	if err != nil {
+		return err
+	}
+
+	f, err := output(*outputPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if *format == "md" {
+		return table.WriteMarkdown(f)
+	}
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	return enc.Encode(table)
+}
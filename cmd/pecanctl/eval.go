@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/ielab/pecan"
+	"github.com/ielab/pecan/eval"
+	"os"
+	"path/filepath"
+)
+
+// evaluate runs topics through pipelines concurrently, writing a run file for each pipeline
+// and, when qrels are given, the measures of each run.
+func evaluate(args []string) error {
+	fs, configPath := newFlagSet("eval")
+	topicsPath := fs.String("topics", "", "path to the topics, in the TREC format or one JSON object per line (required)")
+	names := fs.String("pipelines", "", "comma separated names of the pipelines in the config to run (default all)")
+	depth := fs.Int("depth", pecan.SearchSize, "number of conversations to retrieve for each topic")
+	granularity := fs.String("granularity", eval.DefaultGranularity, "what runs rank: conversation, message, or hit")
+	outputDir := fs.String("output-dir", ".", "directory to write a <pipeline>.run file for each pipeline to, and for conversation runs a <pipeline>.conversations.jsonl sidecar")
+	qrelsPath := fs.String("qrels", "", "path to qrels to score the runs against")
+	cutoff := fs.Int("cutoff", eval.DefaultCutoff, "rank that measures are cut off at")
+	resultsPath := fs.String("results", "-", "path to write the measures of each run to, as JSON")
+	_ = fs.Parse(args)
+
+	if len(*topicsPath) == 0 {
+		fs.Usage()
+		return fmt.Errorf("-topics is required")
+	}
+	switch *granularity {
+	case eval.ConversationGranularity, eval.MessageGranularity, eval.HitGranularity:
+	default:
+		return eval.ErrUnknownGranularity
+	}
+
+	config, err := pecan.NewConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	topics, err := eval.ReadTopics(*topicsPath)
+	if err != nil {
+		return err
+	}
+	pipelines, err := selectPipelines(config, *names)
+	if err != nil {
+		return err
+	}
+	var qrels eval.Qrels
+	if len(*qrelsPath) > 0 {
+		qrels, err = eval.ReadQrels(*qrelsPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	es, fixture, err := pecan.NewElasticClient(config)
+	if err != nil {
+		return err
+	}
+	defer fixture.Close()
+	api := pecan.NewNoChatAPI()
+	exec := pecan.NewTaskExecutor(api, es)
+
+	retrieved, err := eval.RetrievePipelines(context.Background(), exec, api, pipelines, topics, pecan.SearchRequest{Index: config.Elasticsearch.Index}, *depth)
+	if err != nil {
+		return err
+	}
+
+	results := make(map[string]eval.Results)
+	for _, name := range sortedNames(pipelines) {
+		err := writeFile(filepath.Join(*outputDir, name+".run"), func(f *os.File) error {
+			return eval.WriteRun(f, name, *granularity, topics, retrieved[name])
+		})
+		if err != nil {
+			return err
+		}
+		if *granularity == eval.ConversationGranularity {
+			err := writeFile(filepath.Join(*outputDir, name+".conversations.jsonl"), func(f *os.File) error {
+				return eval.WriteSidecar(f, topics, retrieved[name])
+			})
+			if err != nil {
+				return err
+			}
+		}
+		if qrels != nil {
+			results[name] = eval.Evaluate(qrels, eval.ConversationRun(name, retrieved[name]), *cutoff)
+		}
+	}
+
+	if qrels == nil {
+		return nil
+	}
+	f, err := output(*resultsPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	return enc.Encode(results)
+}
+
+// writeFile creates the file at path and writes to it, making sure that it is closed.
+func writeFile(path string, write func(f *os.File) error) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	err = write(f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,98 @@
+// Command pecanctl runs offline tasks against the index that pecanweb searches, such as building judgement pools.
+// It reads the same config.json as pecanweb, and searches every channel in the index.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/ielab/pecan"
+	"os"
+	"sort"
+	"strings"
+)
+
+type command struct {
+	name  string
+	usage string
+	run   func(args []string) error
+}
+
+var commands = []command{
+	{"pool", "build a judgement pool by running topics through pipelines", pool},
+	{"eval", "write a run for each pipeline, and score the runs against qrels", evaluate},
+	{"compare", "test whether scored runs differ significantly", compare},
+	{"user", "add or replace an account of the local chat API", user},
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: pecanctl <command> [flags]")
+	fmt.Fprintln(os.Stderr)
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", c.name, c.usage)
+	}
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "Run pecanctl <command> -h for the flags of a command.")
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	for _, c := range commands {
+		if c.name == os.Args[1] {
+			if err := c.run(os.Args[2:]); err != nil {
+				fmt.Fprintf(os.Stderr, "pecanctl %s: %v\n", c.name, err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+	usage()
+	os.Exit(2)
+}
+
+// selectPipelines looks up the pipelines named in a comma separated list, or all configured pipelines when names is empty.
+// When no pipelines are configured, the default pipeline is used under the name "default".
+func selectPipelines(config *pecan.Config, names string) (map[string]pecan.Pipeline, error) {
+	if len(config.Pipelines) == 0 {
+		config.Pipelines = map[string]pecan.Pipeline{"default": {}}
+	}
+	if len(names) == 0 {
+		return config.Pipelines, nil
+	}
+	pipelines := make(map[string]pecan.Pipeline)
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		p, ok := config.Pipelines[name]
+		if !ok {
+			return nil, fmt.Errorf("no pipeline named %q in config", name)
+		}
+		pipelines[name] = p
+	}
+	return pipelines, nil
+}
+
+// sortedNames are the names of pipelines in a stable order, so that output does not depend on map iteration.
+func sortedNames(pipelines map[string]pecan.Pipeline) []string {
+	names := make([]string, 0, len(pipelines))
+	for name := range pipelines {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// output opens the file at path for writing, or stdout when path is empty or "-".
+func output(path string) (*os.File, error) {
+	if len(path) == 0 || path == "-" {
+		return os.Stdout, nil
+	}
+	return os.Create(path)
+}
+
+func newFlagSet(name string) (*flag.FlagSet, *string) {
+	fs := flag.NewFlagSet("pecanctl "+name, flag.ExitOnError)
+	configPath := fs.String("config", "config.json", "path to the pecan config")
+	return fs, configPath
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/ielab/pecan"
+	"github.com/ielab/pecan/eval"
+)
+
+// pool runs topics through pipelines and pools the conversations they retrieve.
+func pool(args []string) error {
+	fs, configPath := newFlagSet("pool")
+	topicsPath := fs.String("topics", "", "path to the topics, in the TREC format or one JSON object per line (required)")
+	names := fs.String("pipelines", "", "comma separated names of the pipelines in the config to pool (default all)")
+	strategy := fs.String("strategy", "depth", "pooling strategy: depth or mab")
+	depth := fs.Int("depth", 10, "number of conversations of each run to pool with the depth strategy")
+	budget := fs.Int("budget", 100, "number of conversations to pool for each topic with the mab strategy")
+	runDepth := fs.Int("run-depth", 100, "number of conversations to retrieve for each topic with the mab strategy")
+	qrelsPath := fs.String("qrels", "", "path to existing judgements that guide the mab strategy")
+	outputPath := fs.String("output", "-", "path to write the pool to")
+	_ = fs.Parse(args)
+
+	if len(*topicsPath) == 0 {
+		fs.Usage()
+		return fmt.Errorf("-topics is required")
+	}
+	if *strategy != "depth" && *strategy != "mab" {
+		return fmt.Errorf("unknown strategy %q", *strategy)
+	}
+
+	config, err := pecan.NewConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	topics, err := eval.ReadTopics(*topicsPath)
+	if err != nil {
+		return err
+	}
+	pipelines, err := selectPipelines(config, *names)
+	if err != nil {
+		return err
+	}
+	qrels := make(eval.Qrels)
+	if len(*qrelsPath) > 0 {
+		qrels, err = eval.ReadQrels(*qrelsPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	es, fixture, err := pecan.NewElasticClient(config)
+	if err != nil {
+		return err
+	}
+	defer fixture.Close()
+	api := pecan.NewNoChatAPI()
+	exec := pecan.NewTaskExecutor(api, es)
+
+	retrieveDepth := *depth
+	if *strategy == "mab" {
+		retrieveDepth = *runDepth
+	}
+
+	retrieved, err := eval.RetrievePipelines(context.Background(), exec, api, pipelines, topics, pecan.SearchRequest{Index: config.Elasticsearch.Index}, retrieveDepth)
+	if err != nil {
+		return err
+	}
+	var runs []eval.Run
+	for _, name := range sortedNames(pipelines) {
+		runs = append(runs, eval.ConversationRun(name, retrieved[name]))
+	}
+
+	var p pecan.Pool
+	switch *strategy {
+	case "depth":
+		p = eval.DepthPool(topics, runs, *depth)
+	case "mab":
+		p = eval.BanditPool(topics, runs, *budget, qrels)
+	}
+
+	f, err := output(*outputPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return pecan.WritePool(f, p)
+}
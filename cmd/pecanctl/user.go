@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/ielab/pecan"
+	"golang.org/x/term"
+	"os"
+	"strings"
+)
+
+// user manages the accounts of the local chat API. The password of an account is read from stdin,
+// so that it does not end up in the shell history, without echoing it when stdin is a terminal.
+func user(args []string) error {
+	if len(args) == 0 || args[0] != "add" {
+		fmt.Fprintln(os.Stderr, "usage: pecanctl user add -username <name> [-groups a,b] < password")
+		return fmt.Errorf("unknown subcommand")
+	}
+	fs, configPath := newFlagSet("user add")
+	username := fs.String("username", "", "name of the account to add or replace (required)")
+	groups := fs.String("groups", "", "comma separated groups that the account is in, as named in the ACL")
+	usersPath := fs.String("users", "", "path to the users file, instead of the one in the config")
+	_ = fs.Parse(args[1:])
+
+	if len(*username) == 0 {
+		fs.Usage()
+		return fmt.Errorf("-username is required")
+	}
+	path := *usersPath
+	if len(path) == 0 {
+		config, err := pecan.NewConfig(*configPath)
+		if err != nil {
+			return err
+		}
+		path = config.API.Local.Users
+	}
+	if len(path) == 0 {
+		return fmt.Errorf("no users file is configured, use -users")
+	}
+
+	password, err := readPassword()
+	if err != nil {
+		return fmt.Errorf("reading password: %v", err)
+	}
+
+	var memberOf []string
+	for _, group := range strings.Split(*groups, ",") {
+		if group = strings.TrimSpace(group); len(group) > 0 {
+			memberOf = append(memberOf, group)
+		}
+	}
+
+	users, err := pecan.ReadLocalUsers(path)
+	if err != nil {
+		return err
+	}
+	users, err = pecan.SetLocalUser(users, *username, password, memberOf)
+	if err != nil {
+		return err
+	}
+	if err := pecan.WriteLocalUsers(path, users); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "\nSaved %s to %s\n", *username, path)
+	return nil
+}
+
+// readPassword reads a line from stdin, prompting for it without echoing it when stdin is a terminal.
+func readPassword() (string, error) {
+	fd := int(os.Stdin.Fd())
+	if term.IsTerminal(fd) {
+		fmt.Fprint(os.Stderr, "Password: ")
+		b, err := term.ReadPassword(fd)
+		return string(b), err
+	}
+	password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && len(password) == 0 {
+		return "", err
+	}
+	return strings.TrimRight(password, "\r\n"), nil
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/ielab/pecan"
+	"github.com/olivere/elastic/v7"
+	"net/http"
+)
+
+// listSize is the maximum number of channels or users returned by the listing endpoints.
+const listSize = 1000
+
+func apiError(c *gin.Context, code int, err error) {
+	c.AbortWithStatusJSON(code, pecan.ErrorResponse{Error: err.Error()})
+}
+
+// registerAPI adds the JSON endpoints that mirror the HTML pages to a router group.
+func registerAPI(group *gin.RouterGroup, ctx context.Context, es *elastic.Client, api pecan.ChatAPI, exec *pecan.TaskExecutor, config *pecan.Config) {
+	group.GET("/search", func(c *gin.Context) {
+		var request pecan.SearchRequest
+		if err := c.ShouldBind(&request); err != nil {
+			apiError(c, http.StatusBadRequest, err)
+			return
+		}
+		request.SetDefaultDates()
+		request.Context = c
+		request.Index = config.Elasticsearch.Index
+		err := pecan.CheckChannelFilter(api, request)
+		if errors.Is(err, pecan.ErrChannelForbidden) {
+			apiError(c, http.StatusForbidden, err)
+			return
+		}
+		if err != nil {
+			apiError(c, http.StatusInternalServerError, err)
+			return
+		}
+
+		page, err := exec.ForRequest(c).GetConversationPage(ctx, api, request)
+		if errors.Is(err, pecan.ErrCursorExpired) {
+			apiError(c, http.StatusGone, err)
+			return
+		}
+		if err != nil {
+			apiError(c, http.StatusInternalServerError, err)
+			return
+		}
+		facets, err := api.GetFacets(es, ctx, request)
+		if err != nil {
+			apiError(c, http.StatusInternalServerError, err)
+			return
+		}
+		c.JSON(http.StatusOK, pecan.ConversationsResponse{
+			Query:         request.Query,
+			From:          request.From.Format(pecan.DateFormat),
+			To:            request.To.Format(pecan.DateFormat),
+			Channel:       request.Channel,
+			User:          request.User,
+			Start:         page.Start,
+			Cursor:        page.Cursor,
+			Next:          page.Next,
+			Prev:          page.Prev,
+			Conversations: page.Conversations,
+			Facets:        facets,
+		})
+	})
+
+	group.GET("/messages/context", func(c *gin.Context) {
+		var request pecan.SearchRequest
+		if err := c.ShouldBind(&request); err != nil {
+			apiError(c, http.StatusBadRequest, err)
+			return
+		}
+		if err := request.ValidateBaseMessage(); err != nil {
+			apiError(c, http.StatusBadRequest, err)
+			return
+		}
+		request.SetDefaultDates()
+		request.Context = c
+		request.Index = config.Elasticsearch.Index
+
+		messages, err := pecan.MoreMessages(es, api, ctx, []string{request.BaseMessageChannel}, request)
+		if errors.Is(err, pecan.ErrChannelForbidden) {
+			apiError(c, http.StatusForbidden, err)
+			return
+		}
+		if err != nil {
+			apiError(c, http.StatusInternalServerError, err)
+			return
+		}
+		if messages == nil {
+			messages = []pecan.Message{}
+		}
+		c.JSON(http.StatusOK, pecan.MessagesResponse{
+			Channel:  request.BaseMessageChannel,
+			PrevNext: request.PrevNext,
+			Messages: messages,
+		})
+	})
+
+	group.GET("/stats", func(c *gin.Context) {
+		var request pecan.SearchRequest
+		request.SetDefaultDates()
+
+		count, err := pecan.CountMessages(es, api, ctx, c, config.Elasticsearch.Index)
+		if err != nil {
+			apiError(c, http.StatusInternalServerError, err)
+			return
+		}
+		c.JSON(http.StatusOK, pecan.StatisticsResponse{
+			NumMessages: count,
+			From:        request.From.Format(pecan.DateFormat),
+			To:          request.To.Format(pecan.DateFormat),
+		})
+	})
+
+	// Channels and users are listed using facets over every message the user has access to.
+	listFacets := func(c *gin.Context) (pecan.Facets, bool) {
+		var request pecan.SearchRequest
+		request.SetDefaultDates()
+		request.Context = c
+		request.Index = config.Elasticsearch.Index
+		request.FacetSize = listSize
+
+		facets, err := api.GetFacets(es, ctx, request)
+		if err != nil {
+			apiError(c, http.StatusInternalServerError, err)
+			return facets, false
+		}
+		return facets, true
+	}
+
+	group.GET("/channels", func(c *gin.Context) {
+		if facets, ok := listFacets(c); ok {
+			c.JSON(http.StatusOK, pecan.ChannelsResponse{Channels: facets.Channels})
+		}
+	})
+
+	group.GET("/users", func(c *gin.Context) {
+		if facets, ok := listFacets(c); ok {
+			c.JSON(http.StatusOK, pecan.UsersResponse{Users: facets.Users})
+		}
+	})
+}
@@ -1,8 +1,10 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"embed"
+	"errors"
 	"fmt"
 	"github.com/gin-contrib/sessions"
 	"github.com/gin-contrib/sessions/cookie"
@@ -13,8 +15,11 @@ import (
 	"html/template"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
 	"path"
 	"strings"
+	"syscall"
 	"time"
 )
 
@@ -24,6 +29,25 @@ var webFS embed.FS
 //go:embed web/static/*
 var staticFS embed.FS
 
+//go:embed openapi.json
+var openAPISpec []byte
+
+// exportDownload streams conversations to the client as a file in the requested export format.
+func exportDownload(c *gin.Context, format string, start int, conversations []pecan.Conversation) {
+	f, ok := pecan.ExportFormats[format]
+	if !ok {
+		pecan.ErrorPage(c, http.StatusBadRequest, "Bad Request", "Conversations cannot be exported as "+format+".")
+		return
+	}
+	// The file is written before anything is sent, so that a failure is not downloaded as a truncated file.
+	var buf bytes.Buffer
+	if err := f.Write(&buf, start, conversations); err != nil {
+		panic(err)
+	}
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="pecan-%s.%s"`, time.Now().Format("20060102-150405"), f.Extension))
+	c.Data(http.StatusOK, f.ContentType, buf.Bytes())
+}
+
 func main() {
 
 	config, err := pecan.NewConfig("config.json")
@@ -31,21 +55,64 @@ func main() {
 		panic(err)
 	}
 
-	ctx := context.Background()
-
 	var api pecan.ChatAPI
 	switch config.API.Use {
 	case "slack":
-		api = pecan.NewSlackChatAPI(config)
+		tokens, err := pecan.NewTokenStore(config)
+		if err != nil {
+			panic(err)
+		}
+		api = pecan.NewSlackChatAPI(config, tokens)
+	case "oidc":
+		tokens, err := pecan.NewTokenStore(config)
+		if err != nil {
+			panic(err)
+		}
+		api = pecan.NewOIDCChatAPI(config, tokens)
+	case "local":
+		tokens, err := pecan.NewTokenStore(config)
+		if err != nil {
+			panic(err)
+		}
+		api = pecan.NewLocalChatAPI(config, tokens)
 	default:
 		api = pecan.NewNoChatAPI()
 	}
 
-	es, err := elastic.NewClient(elastic.SetURL(config.Elasticsearch.Url), elastic.SetSniff(false))
+	es, fixture, err := pecan.NewElasticClient(config)
 	if err != nil {
 		panic(err)
 	}
+	// The server only stops when it is interrupted, so that is when a fixture being recorded is closed.
+	go func() {
+		stop := make(chan os.Signal, 1)
+		signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+		<-stop
+		if err := fixture.Close(); err != nil {
+			log.Fatalln(err)
+		}
+		os.Exit(0)
+	}()
+
+	router := newRouter(config, es, api)
+
+	fmt.Print(`
+	 ____  _____ ____    _    _   _ 
+	|  _ \| ____/ ___|  / \  | \ | |
+	| |_) |  _|| |     / _ \ |  \| |
+	|  __/| |__| |___ / ___ \| |\  |
+	|_|   |_____\____/_/   \_\_| \_|
+
+	go -> http://localhost:4713
+
+`)
+	log.Fatalln(router.Run(":4713"))
 
+}
+
+// newRouter serves the pages, JSON API, and addons, searching es for the users of the chat API.
+func newRouter(config *pecan.Config, es *elastic.Client, api pecan.ChatAPI) *gin.Engine {
+	ctx := context.Background()
 	exec := pecan.NewTaskExecutor(api, es)
 
 	router := gin.Default()
@@ -57,6 +124,14 @@ func main() {
 					"add": func(a, b int) int {
 						return a + b
 					},
+					"addonEnabled": func(name string) bool {
+						for _, addonName := range config.Addons {
+							if addonName == name {
+								return true
+							}
+						}
+						return false
+					},
 				}).
 			ParseFS(webFS, "web/*.html"))
 	router.SetHTMLTemplate(templates)
@@ -65,6 +140,10 @@ func main() {
 		c.FileFromFS(path.Join("/web/", c.Request.URL.Path), http.FS(staticFS))
 	})
 
+	router.GET("/api/openapi.json", func(c *gin.Context) {
+		c.Data(http.StatusOK, "application/json", openAPISpec)
+	})
+
 	// Middleware for redirecting for authentication.
 	store := cookie.NewStore([]byte(config.Secrets.Cookie))
 	router.Use(sessions.Sessions("pecan", store))
@@ -80,21 +159,52 @@ func main() {
 		c.Next()
 	})
 
+	// Addons are initialised before any routes are added so that their middleware applies to all of them.
+	for _, addonName := range config.Addons {
+		if a, ok := addon.Addons[addonName]; ok {
+			a.Initialise(es, api, config)
+			if m, ok := a.(addon.Middleware); ok {
+				router.Use(m.Middleware())
+			}
+		}
+	}
+
 	router.GET("/", func(c *gin.Context) {
 
 		// Default time values.
 		from := "2010-01-01"
 		to := time.Now().Format("2006-01-02")
 
-		result, err := es.Count(config.Elasticsearch.Index).Do(ctx)
+		result, err := pecan.CountMessages(es, api, ctx, c, config.Elasticsearch.Index)
+		if err != nil {
+			panic(err)
+		}
+
+		// Show conversations around the most recent messages the user has access to.
+		var request pecan.SearchRequest
+		request.SetDefaultDates()
+		request.Context = c
+		request.Index = config.Elasticsearch.Index
+		conversations, err := exec.GetRecentConversations(ctx, api, request)
 		if err != nil {
 			panic(err)
 		}
+
+		// Channel activity is only computed over the most recent days.
+		request.From = request.To.AddDate(0, 0, -pecan.ActivityDays)
+		facets, err := api.GetFacets(es, ctx, request)
+		if err != nil {
+			panic(err)
+		}
+
 		// Build the response.
-		response := pecan.StatisticsResponse{
-			From:        from,
-			To:          to,
-			NumMessages: result,
+		response := pecan.SearchResponse{
+			Type:          pecan.RECENT,
+			From:          from,
+			To:            to,
+			NumMessages:   result,
+			Conversations: conversations,
+			Facets:        facets,
 		}
 		c.HTML(http.StatusOK, "index.html", response)
 		return
@@ -106,16 +216,32 @@ func main() {
 		to := time.Now().Format("2006-01-02")
 
 		var (
-			request       pecan.SearchRequest
-			conversations []pecan.Conversation
+			request pecan.SearchRequest
+			page    pecan.ConversationPage
+			facets  pecan.Facets
 		)
-		// If a query has been submitted, run a search.
-		// Otherwise show recent messages.
-		if err := c.ShouldBind(&request); err == nil && len(request.Query) > 0 {
+		// If a query or filter has been submitted, run a search.
+		if err := c.ShouldBind(&request); err == nil && (len(request.Query) > 0 || len(request.Channel) > 0 || len(request.User) > 0) {
 			request.Context = c
 			request.Index = config.Elasticsearch.Index
+			err = pecan.CheckChannelFilter(api, request)
+			if errors.Is(err, pecan.ErrChannelForbidden) {
+				pecan.ErrorPage(c, http.StatusForbidden, "Forbidden", "You do not have access to this channel.")
+				return
+			}
+			if err != nil {
+				panic(err)
+			}
 			// Determine which method should be used to search.
-			conversations, err = exec.GetConversations(ctx, api, request)
+			page, err = exec.PageFuncForRequest(c)(ctx, api, request)
+			if errors.Is(err, pecan.ErrCursorExpired) {
+				pecan.ErrorPage(c, http.StatusGone, "Gone", "The results of this search have expired, please search again.")
+				return
+			}
+			if err != nil {
+				panic(err)
+			}
+			facets, err = api.GetFacets(es, ctx, request)
 			if err != nil {
 				panic(err)
 			}
@@ -123,27 +249,26 @@ func main() {
 			from = request.From.Format(pecan.DateFormat)
 			to = request.To.Format(pecan.DateFormat)
 
-		}
-
-		// Compute next and previous scrolls.
-		next := request.Start + pecan.SearchSize
-		prev := request.Start - pecan.SearchSize
-
-		if next >= len(conversations) {
-			next = -1
-		}
-		if prev <= pecan.SearchSize {
-			prev = -1
+			if format := c.Query("export"); len(format) > 0 {
+				exportDownload(c, format, page.Start, page.Conversations)
+				return
+			}
 		}
 
 		// Build the response.
 		response := pecan.SearchResponse{
-			Conversations: conversations,
+			Type:          pecan.SEARCH,
+			Conversations: page.Conversations,
 			Query:         request.Query,
 			From:          from,
 			To:            to,
-			Next:          next,
-			Prev:          prev,
+			Start:         page.Start,
+			Cursor:        page.Cursor,
+			Next:          page.Next,
+			Prev:          page.Prev,
+			Channel:       request.Channel,
+			User:          request.User,
+			Facets:        facets,
 		}
 		c.HTML(http.StatusOK, "search.html", response)
 		return
@@ -155,9 +280,21 @@ func main() {
 			messages []pecan.Message
 		)
 		if err := c.ShouldBind(&request); err == nil {
+			if err := request.ValidateBaseMessage(); err != nil {
+				pecan.ErrorPage(c, http.StatusBadRequest, "Bad Request", "The message to show more messages around was not given.")
+				return
+			}
+			request.Context = c
 			var channel []string
 			channel = append(channel, request.BaseMessageChannel)
 			messages, err = pecan.MoreMessages(es, api, ctx, channel, request)
+			if errors.Is(err, pecan.ErrChannelForbidden) {
+				pecan.ErrorPage(c, http.StatusForbidden, "Forbidden", "You do not have access to the channel of this message.")
+				return
+			}
+			if err != nil {
+				panic(err)
+			}
 		}
 		response := pecan.SearchResponse{
 			Messages: messages,
@@ -168,13 +305,61 @@ func main() {
 		c.HTML(http.StatusOK, "more_messages.html", response)
 		return
 	})
+	router.GET("/conversation/:id", func(c *gin.Context) {
+		id, err := pecan.ParseConversationID(c.Param("id"))
+		if err != nil {
+			pecan.ErrorPage(c, http.StatusNotFound, "Not Found", "This conversation does not exist.")
+			return
+		}
+
+		var request pecan.SearchRequest
+		request.SetDefaultDates()
+		request.Context = c
+		request.Index = config.Elasticsearch.Index
+		conversation, err := exec.ForRequest(c).GetConversation(ctx, api, id, request)
+		if errors.Is(err, pecan.ErrChannelForbidden) {
+			pecan.ErrorPage(c, http.StatusForbidden, "Forbidden", "You do not have access to the channel of this conversation.")
+			return
+		}
+		if err != nil {
+			panic(err)
+		}
+		if len(conversation.Messages) == 0 {
+			pecan.ErrorPage(c, http.StatusNotFound, "Not Found", "This conversation does not exist.")
+			return
+		}
+		if format := c.Query("export"); len(format) > 0 {
+			exportDownload(c, format, 0, []pecan.Conversation{conversation})
+			return
+		}
+
+		c.HTML(http.StatusOK, "conversation.html", pecan.ConversationResponse{
+			Conversation: conversation,
+			From:         request.From.Format(pecan.DateFormat),
+			To:           request.To.Format(pecan.DateFormat),
+		})
+	})
+
+	registerAPI(router.Group(pecan.APIPath), ctx, es, api, exec, config)
+
 	router.GET("/login", func(c *gin.Context) {
-		c.HTML(http.StatusOK, "login.html", config)
+		c.HTML(http.StatusOK, "login.html", pecan.LoginResponse{Config: config, LoginToken: pecan.LoginToken(c)})
 		return
 	})
 	router.GET("/logout", func(c *gin.Context) {
+		api.HandleLogout(c)
 		session := sessions.Default(c)
 		session.Clear()
+		if err := session.Save(); err != nil {
+			panic(err)
+		}
+		c.Redirect(http.StatusFound, "/login")
+	})
+	router.GET("/login/start", func(c *gin.Context) {
+		api.HandleLogin(c)
+	})
+	router.POST("/login/start", func(c *gin.Context) {
+		api.HandleLogin(c)
 	})
 	router.GET("/login/oauth", func(c *gin.Context) {
 		api.HandleOAuth(c)
@@ -182,22 +367,10 @@ func main() {
 
 	for _, addonName := range config.Addons {
 		if a, ok := addon.Addons[addonName]; ok {
-			a.Initialise(es, api, config)
 			router.GET(path.Join("/addon/", addonName), a.Handler())
 			router.POST(path.Join("/addon/", addonName), a.Handler())
 		}
 	}
 
-	fmt.Print(`
-	 ____  _____ ____    _    _   _ 
-	|  _ \| ____/ ___|  / \  | \ | |
-	| |_) |  _|| |     / _ \ |  \| |
-	|  __/| |__| |___ / ___ \| |\  |
-	|_|   |_____\____/_/   \_\_| \_|
-
-	go -> http://localhost:4713
-
-`)
-	log.Fatalln(router.Run(":4713"))
-
+	return router
 }
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/ielab/pecan"
+	"github.com/olivere/elastic/v7"
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// secret is the text of the message in C2, which alice cannot read.
+const secret = "the launch codes"
+
+// messageTime and earlierTime are when the two messages in each channel were sent.
+const (
+	messageTime = "1615256000.000100"
+	earlierTime = "1615255940.000100"
+)
+
+// fakeSearch answers searches with the messages in C1 when they mention C1 or its messages, and with the
+// messages in C2 otherwise, so that routes which do not check access would show the secret. The bodies
+// of counts are kept in counts.
+type fakeSearch struct {
+	sync.Mutex
+	counts []string
+}
+
+func (f *fakeSearch) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	w.Header().Set("Content-Type", "application/json")
+	if strings.HasSuffix(r.URL.Path, "/_count") {
+		f.Lock()
+		f.counts = append(f.counts, string(body))
+		f.Unlock()
+		fmt.Fprint(w, `{"count":1}`)
+		return
+	}
+	channel, text := "C2", secret
+	if strings.Contains(string(body), "C1") {
+		channel, text = "C1", "hello"
+	}
+	var hits []string
+	for i, ts := range []string{messageTime, earlierTime} {
+		hits = append(hits, fmt.Sprintf(`{"_id":"m%s%s","_score":1,"_source":{"channel":%q,"user":"U1","text":%q,"ts":%q,"event_ts":%q}}`,
+			channel, strings.Repeat("-", i), channel, text, ts, ts))
+	}
+	fmt.Fprintf(w, `{"took":1,"hits":{"total":{"value":%d,"relation":"eq"},"hits":[%s]}}`, len(hits), strings.Join(hits, ","))
+}
+
+// testConfig configures the local chat API with an account for alice, whose password is "password" and who can
+// only read C1, and the assessment addon with a topic whose items are the conversation and message in C2.
+func testConfig(t *testing.T) *pecan.Config {
+	dir := t.TempDir()
+	config := new(pecan.Config)
+	config.Secrets.Cookie = "secret"
+	config.API.Use = "local"
+	config.API.Local.Users = filepath.Join(dir, "users.json")
+	config.API.Local.ACL = filepath.Join(dir, "acl.json")
+	config.Addons = []string{"assessment", "evaluation"}
+	config.Assessment.Pool = filepath.Join(dir, "pool.json")
+	config.Assessment.Output = filepath.Join(dir, "assessment.jsonl")
+
+	users, err := pecan.SetLocalUser(nil, "alice", "password", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pecan.WriteLocalUsers(config.API.Local.Users, users); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]interface{}{
+		config.API.Local.ACL: pecan.ACL{Users: map[string][]string{"alice": {"C1"}}},
+		config.Assessment.Pool: pecan.Pool{Topics: []pecan.PoolTopic{
+			{Id: "1", Title: "launch", Items: []string{forbiddenConversation, "mC2"}},
+		}},
+	}
+	for path, v := range files {
+		b, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, b, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return config
+}
+
+var (
+	readableConversation  = pecan.ConversationID{Channel: "C1", Start: messageTime, End: messageTime}.String()
+	forbiddenConversation = pecan.ConversationID{Channel: "C2", Start: messageTime, End: messageTime}.String()
+	loginToken            = regexp.MustCompile(`name="login_token" value="([^"]+)"`)
+)
+
+// login logs alice in to a server, returning a client that keeps their session and does not follow redirects.
+func login(t *testing.T, server *httptest.Server) *http.Client {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{
+		Jar: jar,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	resp, err := client.Get(server.URL + "/login")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	match := loginToken.FindSubmatch(body)
+	if match == nil {
+		t.Fatalf("the login page has no token: %s", body)
+	}
+	resp, err = client.PostForm(server.URL+"/login/start", url.Values{
+		"username":    {"alice"},
+		"password":    {"password"},
+		"login_token": {string(match[1])},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound || resp.Header.Get("Location") != "/" {
+		t.Fatalf("login responded %d", resp.StatusCode)
+	}
+	return client
+}
+
+// session makes requests to a server with the session of a logged in user.
+type session struct {
+	*http.Client
+	url string
+}
+
+// do makes a request, returning the status and body of the response.
+func (s session) do(t *testing.T, method, path, contentType, body string) (int, string) {
+	r, err := http.NewRequest(method, s.url+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(contentType) > 0 {
+		r.Header.Set("Content-Type", contentType)
+	}
+	resp, err := s.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, _ := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, string(b)
+}
+
+// serve serves pecanweb over the fake search, returning the session of alice.
+func serve(t *testing.T, search *fakeSearch) session {
+	gin.SetMode(gin.TestMode)
+	gin.DefaultWriter = ioutil.Discard
+	esServer := httptest.NewServer(search)
+	t.Cleanup(esServer.Close)
+	es, err := elastic.NewClient(elastic.SetURL(esServer.URL), elastic.SetSniff(false), elastic.SetHealthcheck(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := testConfig(t)
+	server := httptest.NewServer(newRouter(config, es, pecan.NewLocalChatAPI(config, pecan.NewMemoryTokenStore(0))))
+	t.Cleanup(server.Close)
+	return session{Client: login(t, server), url: server.URL}
+}
+
+// TestForbiddenChannels checks that the routes which retrieve messages from a channel given in the request
+// refuse channels that the user cannot read, without showing any of their messages.
+func TestForbiddenChannels(t *testing.T) {
+	search := new(fakeSearch)
+	do := serve(t, search).do
+
+	code, _ := do(t, http.MethodPost, "/addon/assessment", "application/x-www-form-urlencoded", url.Values{"action": {"start"}, "assessor": {"alice"}}.Encode())
+	if code != http.StatusFound {
+		t.Fatalf("starting to assess responded %d", code)
+	}
+
+	contextForm := func(channel string) url.Values {
+		return url.Values{"base_message_channel": {channel}, "base_message_time": {messageTime}}
+	}
+	routes := []struct {
+		name              string
+		method, path      string
+		contentType, body string
+		readable          bool
+	}{
+		{"more messages", http.MethodPost, "/more_messages", "application/x-www-form-urlencoded", contextForm("C2").Encode(), false},
+		{"message context", http.MethodGet, "/api/v1/messages/context?" + contextForm("C2").Encode(), "", "", false},
+		{"readable message context", http.MethodGet, "/api/v1/messages/context?" + contextForm("C1").Encode(), "", "", true},
+		{"conversation", http.MethodGet, "/conversation/" + forbiddenConversation, "", "", false},
+		{"readable conversation", http.MethodGet, "/conversation/" + readableConversation, "", "", true},
+		{"conversation export", http.MethodGet, "/conversation/" + forbiddenConversation + "?export=csv", "", "", false},
+		{"readable search", http.MethodGet, "/search?q=greeting&channel=C1", "", "", true},
+		{"search export", http.MethodGet, "/search?q=launch&channel=C2&export=csv", "", "", false},
+		{"search", http.MethodGet, "/api/v1/search?q=launch&channel=C2", "", "", false},
+		{"assessment of a conversation", http.MethodGet, "/addon/assessment?topic=1&item=0", "", "", false},
+		{"assessment of a message", http.MethodGet, "/addon/assessment?topic=1&item=1", "", "", false},
+		{"evaluation", http.MethodPost, "/addon/evaluation", "application/json", `{"query":"launch","channel":"C2"}`, false},
+		{"evaluation topics", http.MethodPost, "/addon/evaluation", "application/json", `{"topics":"{\"id\":\"1\",\"query\":\"greeting\",\"channel\":\"C1\"}\n{\"id\":\"2\",\"query\":\"launch\",\"channel\":\"C2\"}\n","pipelines":{"a":{},"b":{"scorer":"message"}}}`, false},
+	}
+	for _, route := range routes {
+		t.Run(route.name, func(t *testing.T) {
+			code, body := do(t, route.method, route.path, route.contentType, route.body)
+			if route.readable {
+				if code != http.StatusOK || !strings.Contains(body, "hello") {
+					t.Errorf("responded %d: %s", code, body)
+				}
+				return
+			}
+			if code != http.StatusForbidden {
+				t.Errorf("responded %d: %s", code, body)
+			}
+			if strings.Contains(body, secret) {
+				t.Errorf("showed the messages of C2: %s", body)
+			}
+		})
+	}
+
+	t.Run("stats", func(t *testing.T) {
+		code, body := do(t, http.MethodGet, "/api/v1/stats", "", "")
+		if code != http.StatusOK {
+			t.Fatalf("responded %d: %s", code, body)
+		}
+		search.Lock()
+		defer search.Unlock()
+		if len(search.counts) == 0 {
+			t.Fatal("did not count any messages")
+		}
+		count := search.counts[len(search.counts)-1]
+		if !strings.Contains(count, `"C1"`) || strings.Contains(count, `"C2"`) {
+			t.Errorf("counted the messages matching %s, want only those in C1", count)
+		}
+	})
+}
+
+func TestMessageContextValidation(t *testing.T) {
+	do := serve(t, new(fakeSearch)).do
+	requests := []url.Values{
+		{"base_message_time": {messageTime}},
+		{"base_message_channel": {"C1"}},
+		{"base_message_channel": {"C1"}, "base_message_time": {"yesterday"}},
+	}
+	for _, request := range requests {
+		code, body := do(t, http.MethodGet, "/api/v1/messages/context?"+request.Encode(), "", "")
+		if code != http.StatusBadRequest || !strings.Contains(body, pecan.ErrInvalidBaseMessage.Error()) {
+			t.Errorf("%s: responded %d: %s", request.Encode(), code, body)
+		}
+		code, _ = do(t, http.MethodPost, "/more_messages", "application/x-www-form-urlencoded", request.Encode())
+		if code != http.StatusBadRequest {
+			t.Errorf("%s: more messages responded %d", request.Encode(), code)
+		}
+	}
+}
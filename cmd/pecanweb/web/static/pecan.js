@@ -0,0 +1,15 @@
+// Copy the absolute URL of a conversation to the clipboard.
+document.addEventListener("click", function (e) {
+    var button = e.target.closest(".copy-link");
+    if (!button) {
+        return;
+    }
+    var url = window.location.origin + button.getAttribute("data-href");
+    navigator.clipboard.writeText(url).then(function () {
+        var text = button.textContent;
+        button.textContent = "Copied!";
+        setTimeout(function () {
+            button.textContent = text;
+        }, 1500);
+    });
+});
@@ -16,7 +16,34 @@ type Config struct {
 			ClientId      string `json:"client_id"`
 			ClientSecret  string `json:"client_secret"`
 			SigningSecret string `json:"signing_secret"`
+			// URL is the slack API that requests are made to, ending in a slash, when it is not slack itself.
+			URL string `json:"url,omitempty"`
+			// Scopes are requested when users log in, instead of the defaults.
+			Scopes []string `json:"scopes"`
+			// SignInWithSlack logs users in with OpenID Connect, which only identifies them,
+			// so the channels they are a member of are listed with the bot token.
+			SignInWithSlack bool   `json:"sign_in_with_slack"`
+			RedirectURL     string `json:"redirect_url"`
+			// TeamId restricts logins to the members of a single workspace.
+			TeamId string `json:"team_id"`
 		} `json:"slack"`
+		// OIDC logs users in with an OpenID Connect issuer. Channels maps claims of the id token, and their values,
+		// to the channels that users with them can read, where "*" is every channel.
+		OIDC struct {
+			Name         string                         `json:"name"`
+			Issuer       string                         `json:"issuer"`
+			ClientId     string                         `json:"client_id"`
+			ClientSecret string                         `json:"client_secret"`
+			RedirectURL  string                         `json:"redirect_url"`
+			Scopes       []string                       `json:"scopes"`
+			Channels     map[string]map[string][]string `json:"channels"`
+		} `json:"oidc"`
+		// Local logs users in with the accounts in a users file, as written by pecanctl user add,
+		// and grants them the channels in an ACL file.
+		Local struct {
+			Users string `json:"users"`
+			ACL   string `json:"acl"`
+		} `json:"local"`
 	}
 	Elasticsearch struct {
 		Login struct {
@@ -25,11 +52,47 @@ type Config struct {
 		} `json:"login"`
 		Index string `json:"index"`
 		Url   string `json:"url"`
+		// Fixture records requests to elasticsearch to, or replays them from, a file.
+		Fixture struct {
+			Mode string `json:"mode"`
+			Path string `json:"path"`
+		} `json:"fixture"`
 	} `json:"elasticsearch"`
 	Secrets struct {
 		Cookie string `json:"cookie"`
 	} `json:"secrets"`
+	// Tokens configures where the access tokens of logged in users are kept: in "memory", or in an encrypted "file"
+	// at path. Tokens expire after expiry, a duration such as "168h".
+	Tokens struct {
+		Store  string `json:"store"`
+		Path   string `json:"path"`
+		Expiry string `json:"expiry"`
+	} `json:"tokens"`
 	Addons []string `json:"addons"`
+	// Pipelines are named pipelines that offline tools such as pecanctl can run topics through.
+	Pipelines map[string]Pipeline `json:"pipelines"`
+	Logging   struct {
+		Output  string `json:"output"`
+		Path    string `json:"path"`
+		MaxSize int64  `json:"max_size"`
+		Index   string `json:"index"`
+	} `json:"logging"`
+	UserStudy struct {
+		Study     string `json:"study"`
+		Output    string `json:"output"`
+		ExportKey string `json:"export_key"`
+	} `json:"userstudy"`
+	Assessment struct {
+		Pool      string  `json:"pool"`
+		Output    string  `json:"output"`
+		ExportKey string  `json:"export_key"`
+		Grades    []Grade `json:"grades"`
+	} `json:"assessment"`
+	Interleaving struct {
+		Method string      `json:"method"`
+		Pairs  [][2]string `json:"pairs"`
+		Output string      `json:"output"`
+	} `json:"interleaving"`
 }
 
 // NewConfig creates a new config that can be used, as read
@@ -0,0 +1,140 @@
+package pecan
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"github.com/olivere/elastic/v7"
+	"sort"
+	"strings"
+)
+
+// MaxConversationSize is the maximum number of messages retrieved when a conversation is re-materialised.
+const MaxConversationSize = 1000
+
+// ConversationID identifies a conversation by the channel it occurred in
+// and the timestamps of its first and last messages.
+type ConversationID struct {
+	Channel string
+	Start   string
+	End     string
+}
+
+var errInvalidConversationID = errors.New("invalid conversation id")
+
+// ErrMessageNotFound is returned when there is no message with an id.
+var ErrMessageNotFound = errors.New("message not found")
+
+// String encodes the id so that it is safe to use in URLs and run files.
+func (id ConversationID) String() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(id.Channel + "\n" + id.Start + "\n" + id.End))
+}
+
+// ParseConversationID decodes an id previously encoded by String.
+func ParseConversationID(s string) (ConversationID, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return ConversationID{}, errInvalidConversationID
+	}
+	parts := strings.Split(string(b), "\n")
+	if len(parts) != 3 || len(parts[0]) == 0 || len(parts[1]) == 0 || len(parts[2]) == 0 {
+		return ConversationID{}, errInvalidConversationID
+	}
+	return ConversationID{Channel: parts[0], Start: parts[1], End: parts[2]}, nil
+}
+
+// ID is the identifier of the conversation, which stays the same for as long as its messages do.
+func (c Conversation) ID() ConversationID {
+	if len(c.Messages) == 0 {
+		return ConversationID{}
+	}
+	return ConversationID{
+		Channel: c.Messages[0].Channel,
+		Start:   c.Messages[0].Timestamp,
+		End:     c.Messages[len(c.Messages)-1].Timestamp,
+	}
+}
+
+// GetConversation re-materialises the conversation with an id using the bounds function of the executor.
+// Starting from its first message, the messages that the bounds function places around the latest message
+// found so far are added until its last message is reached, so that it contains the messages that the pipeline
+// put in it rather than every message sent in the channel at the time.
+// It returns ErrChannelForbidden when the authenticated user of the request cannot read the channel.
+func (exec *TaskExecutor) GetConversation(ctx context.Context, api ChatAPI, id ConversationID, request SearchRequest) (Conversation, error) {
+	ok, err := api.CanReadChannel(request.Context, id.Channel)
+	if err != nil {
+		return Conversation{}, err
+	}
+	if !ok {
+		return Conversation{}, ErrChannelForbidden
+	}
+	resp, err := exec.es.Search(request.Index).
+		Query(elastic.NewBoolQuery().Must(
+			elastic.NewRangeQuery("ts").Gte(id.Start).Lte(id.Start),
+			elastic.NewBoolQuery().Must(buildChannelFilterQuery([]string{id.Channel})...))).
+		Size(1).
+		Sort("ts", true).
+		Do(ctx)
+	if err != nil {
+		return Conversation{}, err
+	}
+	first, err := api.ConvertSearchResponseToMessages(resp)
+	if err != nil || len(first) == 0 {
+		return Conversation{}, err
+	}
+
+	var messages []Message
+	seen := make(map[string]bool)
+	for seed := first[0]; len(messages) < MaxConversationSize; {
+		bounded, err := exec.BoundsFunc(exec.es, api, ctx, id.Channel, seed, request)
+		if err != nil {
+			return Conversation{}, err
+		}
+		latest := seed
+		for _, message := range bounded {
+			if message.Timestamp < id.Start || message.Timestamp > id.End || seen[message.Id] {
+				continue
+			}
+			seen[message.Id] = true
+			messages = append(messages, message)
+			if message.Timestamp > latest.Timestamp {
+				latest = message
+			}
+		}
+		if latest.Timestamp == seed.Timestamp || latest.Timestamp == id.End {
+			break
+		}
+		seed = latest
+	}
+	sort.SliceStable(messages, func(i, j int) bool {
+		return messages[i].Timestamp < messages[j].Timestamp
+	})
+	return Conversation{Messages: messages}, nil
+}
+
+// GetMessage retrieves the message with an id.
+// It returns ErrChannelForbidden when the authenticated user of the request cannot read the channel of the message.
+func GetMessage(es *elastic.Client, api ChatAPI, ctx context.Context, id string, request SearchRequest) (Message, error) {
+	resp, err := es.Search(request.Index).
+		Query(elastic.NewIdsQuery().Ids(id)).
+		Size(1).
+		Do(ctx)
+	if err != nil {
+		return Message{}, err
+	}
+	messages, err := api.ConvertSearchResponseToMessages(resp)
+	if err != nil {
+		return Message{}, err
+	}
+	if len(messages) == 0 {
+		return Message{}, ErrMessageNotFound
+	}
+	ok, err := api.CanReadChannel(request.Context, messages[0].Channel)
+	if err != nil {
+		return Message{}, err
+	}
+	if !ok {
+		return Message{}, ErrChannelForbidden
+	}
+	return messages[0], nil
+}
@@ -0,0 +1,96 @@
+package pecan
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+)
+
+// ErrCursorExpired is returned for a cursor whose point in time has expired.
+var ErrCursorExpired = errors.New("the results of this search have expired, please search again")
+
+// MaxCursorHistory is the number of earlier pages whose positions a cursor keeps, so that it stays
+// the same size no matter how deep results are paged.
+const MaxCursorHistory = 5
+
+// cursorPage is the position of a single page of conversations.
+type cursorPage struct {
+	// After is the sort value of the last hit consumed by the pages before this one.
+	After []interface{} `json:"a,omitempty"`
+	// Start is the rank of the first conversation on this page.
+	Start int `json:"s,omitempty"`
+}
+
+// Cursor is the position of a page of conversations within the ranked hits of a query.
+// The positions of the few pages before it are kept so that previous pages can be reached,
+// and once they have all been gone back through, the previous page is the first page.
+type Cursor struct {
+	// PIT is the id of the point in time that every page of the cursor is retrieved from.
+	PIT string `json:"t,omitempty"`
+	// Current is the position of the current page, and Page is its number, counting from zero.
+	Current cursorPage `json:"c"`
+	Page    int        `json:"n,omitempty"`
+	// History are the positions of up to MaxCursorHistory pages before the current one, the most recent last.
+	History []cursorPage `json:"h,omitempty"`
+}
+
+// DecodeCursor decodes a cursor previously produced by Encode.
+// An empty string decodes to the cursor of the first page.
+func DecodeCursor(s string) (Cursor, error) {
+	var cursor Cursor
+	if len(s) == 0 {
+		return cursor, nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return cursor, err
+	}
+	// Sort values must survive the round trip exactly, so numbers are not converted to floats.
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	err = d.Decode(&cursor)
+	return cursor, err
+}
+
+// Encode encodes the cursor into an opaque string that is safe to use in a URL.
+func (c Cursor) Encode() string {
+	b, err := json.Marshal(c)
+	if err != nil {
+		return ""
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// After is the search_after value that hits for the current page should be retrieved from.
+func (c Cursor) After() []interface{} {
+	return c.Current.After
+}
+
+// Start is the rank of the first conversation on the current page.
+func (c Cursor) Start() int {
+	return c.Current.Start
+}
+
+// Next is the cursor of the page that starts after the hit with the sort value after,
+// and whose first conversation has the rank start.
+func (c Cursor) Next(after []interface{}, start int) Cursor {
+	history := append(c.History[:len(c.History):len(c.History)], c.Current)
+	if len(history) > MaxCursorHistory {
+		history = history[len(history)-MaxCursorHistory:]
+	}
+	return Cursor{PIT: c.PIT, Current: cursorPage{After: after, Start: start}, Page: c.Page + 1, History: history}
+}
+
+// Prev is the cursor of the page before the current one.
+// The second return value is false when the current page is the first page.
+func (c Cursor) Prev() (Cursor, bool) {
+	if c.Page == 0 {
+		return Cursor{}, false
+	}
+	if len(c.History) == 0 {
+		return Cursor{PIT: c.PIT}, true
+	}
+	last := len(c.History) - 1
+	return Cursor{PIT: c.PIT, Current: c.History[last], Page: c.Page - 1, History: c.History[:last]}, true
+}
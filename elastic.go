@@ -2,14 +2,21 @@ package pecan
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"github.com/gin-gonic/gin"
 	"github.com/olivere/elastic/v7"
+	"html/template"
+	"io"
+	"net/http"
 	"strconv"
+	"strings"
 	"time"
 )
 
 type Message struct {
-	Score           float64
-	Id              string
+	Score           float64  `json:"score,omitempty"`
+	Id              string   `json:"id,omitempty"`
 	User            string   `json:"user,omitempty"`
 	SubType         string   `json:"subtype,omitempty"`
 	PreviousMessage *Message `json:"previous_message,omitempty"`
@@ -19,11 +26,41 @@ type Message struct {
 	EventTimestamp  string   `json:"event_ts,omitempty"`
 	Timestamp       string   `json:"ts,omitempty"`
 	Text            string   `json:"text,omitempty"`
+
+	// Hit is true when the message was retrieved by the query rather than added as context.
+	Hit bool `json:"hit,omitempty"`
+	// Highlight contains the fragments of the text that matched the query, with matched terms
+	// surrounded by <mark> tags and the rest of the text already HTML escaped.
+	Highlight []string `json:"highlight,omitempty"`
+	// Sort is the sort value of a hit, used to retrieve the hits that follow it.
+	Sort []interface{} `json:"-"`
+}
+
+// decodeMessage decodes a message from the source of a hit. The fields that describe the hit rather than the
+// message are shadowed, so that they are only set from the hit even when the indexed document has them.
+func decodeMessage(source json.RawMessage) (Message, error) {
+	var doc struct {
+		Message
+		Score     json.RawMessage `json:"score,omitempty"`
+		Id        json.RawMessage `json:"id,omitempty"`
+		Hit       json.RawMessage `json:"hit,omitempty"`
+		Highlight json.RawMessage `json:"highlight,omitempty"`
+	}
+	err := json.Unmarshal(source, &doc)
+	return doc.Message, err
+}
+
+// HighlightedText returns the text of a message with any terms that matched the query marked.
+func (m Message) HighlightedText() template.HTML {
+	if len(m.Highlight) == 0 {
+		return template.HTML(template.HTMLEscapeString(m.Text))
+	}
+	return template.HTML(strings.Join(m.Highlight, " &hellip; "))
 }
 
 type Conversation struct {
-	Score    float64
-	Messages []Message
+	Score    float64   `json:"score"`
+	Messages []Message `json:"messages"`
 }
 
 // buildChannelFilterQuery constructs an elasticsearch query that corresponds to a filter on selected channels.
@@ -35,22 +72,119 @@ func buildChannelFilterQuery(channels []string) []elastic.Query {
 	return filters
 }
 
+// buildSearchQuery constructs the elasticsearch query for a search request over the selected channels,
+// including any channel or user filter that has been applied to the request.
+// A request without a query matches every message.
+func buildSearchQuery(channels []string, request SearchRequest) *elastic.BoolQuery {
+	var text elastic.Query = elastic.NewMatchQuery("text", request.Query)
+	if len(request.Query) == 0 {
+		text = elastic.NewMatchAllQuery()
+	}
+	query := elastic.NewBoolQuery().Must(
+		text,
+		elastic.NewRangeQuery("ts").Gte(request.From.Unix()).Lte(request.To.Add(24*time.Hour).Unix()),
+		elastic.NewBoolQuery().Should(buildChannelFilterQuery(channels)...))
+	if len(request.Channel) > 0 {
+		query = query.Filter(elastic.NewMatchQuery("channel", request.Channel))
+	}
+	if len(request.User) > 0 {
+		query = query.Filter(elastic.NewMatchQuery("user", request.User))
+	}
+	return query
+}
+
+// PITKeepAlive is how long a point in time is kept open between requests for pages of hits,
+// which is long enough to read a page of results before asking for the next.
+const PITKeepAlive = "5m"
+
+// openPointInTime opens a point in time over an index so that hits are paged from a consistent view of it,
+// even while new messages are being indexed. It must be closed once it is no longer needed.
+func openPointInTime(es *elastic.Client, ctx context.Context, index string) (string, error) {
+	resp, err := es.OpenPointInTime(index).KeepAlive(PITKeepAlive).Do(ctx)
+	if err != nil {
+		return "", err
+	}
+	return resp.Id, nil
+}
+
 // queryMessages retrieves indexed messages using a search request.
+// Hits are ranked by score then time, and are retrieved after the sort value in request.After when it is set.
+// When the request has a point in time, hits are retrieved from it instead of the index.
 func queryMessages(es *elastic.Client, ctx context.Context, channels []string, request SearchRequest) (*elastic.SearchResult, error) {
-	return es.Search(request.Index).
-		Query(elastic.NewBoolQuery().Must(
-			elastic.NewMatchQuery("text", request.Query),
-			elastic.NewRangeQuery("ts").Gte(request.From.Unix()).Lte(request.To.Add(24*time.Hour).Unix()),
-			elastic.NewBoolQuery().Should(buildChannelFilterQuery(channels)...))).
-		From(request.Start).
+	search := es.Search(request.Index)
+	if len(request.PIT) > 0 {
+		// Searches over a point in time must not specify an index.
+		search = es.Search().PointInTime(elastic.NewPointInTime(request.PIT, PITKeepAlive))
+	}
+	search = search.Sort("_score", false).Sort("ts", false)
+	if len(request.PIT) > 0 {
+		// Ties are broken by the position of hits in the point in time,
+		// so that search_after neither skips nor repeats messages sent at the same time.
+		search = search.Sort("_shard_doc", true)
+	}
+	if len(request.After) > 0 {
+		search = search.SearchAfter(request.After...)
+	}
+	return search.
+		Query(buildSearchQuery(channels, request)).
+		Highlight(elastic.NewHighlight().
+			Field("text").
+			Encoder("html").
+			PreTags("<mark>").
+			PostTags("</mark>").
+			NumOfFragments(0)).
 		Size(SearchSize).
 		TrackScores(true).
-		Sort("ts", false).
 		Do(ctx)
 }
 
+// ErrChannelForbidden is returned when the authenticated user asks for messages in a channel they cannot read.
+var ErrChannelForbidden = errors.New("you do not have access to this channel")
+
+// CheckChannelFilter returns ErrChannelForbidden when a request is restricted to a channel that the authenticated user cannot read.
+func CheckChannelFilter(api ChatAPI, request SearchRequest) error {
+	if len(request.Channel) == 0 {
+		return nil
+	}
+	ok, err := api.CanReadChannel(request.Context, request.Channel)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrChannelForbidden
+	}
+	return nil
+}
+
+// CountMessages counts the messages in the channels that the authenticated user can read.
+func CountMessages(es *elastic.Client, api ChatAPI, ctx context.Context, c *gin.Context, index string) (int64, error) {
+	channels, all, err := api.ReadableChannels(c)
+	if err != nil {
+		return 0, err
+	}
+	count := es.Count(index)
+	if !all {
+		if len(channels) == 0 {
+			return 0, nil
+		}
+		count = count.Query(elastic.NewBoolQuery().Should(buildChannelFilterQuery(channels)...))
+	}
+	return count.Do(ctx)
+}
+
 // MoreMessages retrieves extra messages if required by the user
+// in channels that the authenticated user can read, or returns ErrChannelForbidden.
 func MoreMessages(es *elastic.Client, api ChatAPI, ctx context.Context, channels []string, request SearchRequest) ([]Message, error) {
+	for _, channel := range channels {
+		ok, err := api.CanReadChannel(request.Context, channel)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, ErrChannelForbidden
+		}
+	}
+
 	var result []Message
 	var searchresult *elastic.SearchResult
 	var err error
@@ -128,3 +262,39 @@ func MoreMessages(es *elastic.Client, api ChatAPI, ctx context.Context, channels
 	}
 	return result, err
 }
+
+// NewElasticClient connects to the elasticsearch cluster configured in config.
+// When a fixture mode is configured, requests are recorded to or replayed from the fixture,
+// and when replaying there is no need for the cluster to be available.
+// The closer closes the fixture, if any, and must be called once the client is no longer used.
+func NewElasticClient(config *Config) (*elastic.Client, io.Closer, error) {
+	options := []elastic.ClientOptionFunc{elastic.SetURL(config.Elasticsearch.Url), elastic.SetSniff(false)}
+	var closer io.Closer = noFixture{}
+	if mode := config.Elasticsearch.Fixture.Mode; len(mode) > 0 {
+		transport, err := NewFixtureTransport(mode, config.Elasticsearch.Fixture.Path, http.DefaultTransport)
+		if err != nil {
+			return nil, nil, err
+		}
+		closer = transport
+		options = append(options, elastic.SetHttpClient(&http.Client{Transport: transport}))
+		if mode == FixtureReplay {
+			options = append(options, elastic.SetHealthcheck(false))
+			if recorded, ok := transport.RecordedOn(); ok {
+				today = func() time.Time { return recorded }
+			}
+		}
+	}
+	es, err := elastic.NewClient(options...)
+	if err != nil {
+		closer.Close()
+		return nil, nil, err
+	}
+	return es, closer, nil
+}
+
+// noFixture is the closer of a client that does not use a fixture.
+type noFixture struct{}
+
+func (noFixture) Close() error {
+	return nil
+}
@@ -0,0 +1,21 @@
+package pecan
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestDecodeMessage(t *testing.T) {
+	// A document with the fields that describe a hit must not set them.
+	source := json.RawMessage(`{"channel":"C1","user":"U1","text":"hello","ts":"1615256000.000100","id":"forged","score":99,"hit":true,"highlight":["<script>"]}`)
+	msg, err := decodeMessage(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Channel != "C1" || msg.User != "U1" || msg.Text != "hello" || msg.Timestamp != "1615256000.000100" {
+		t.Errorf("decoded %+v", msg)
+	}
+	if len(msg.Id) > 0 || msg.Score != 0 || msg.Hit || len(msg.Highlight) > 0 {
+		t.Errorf("the document set the fields of the hit: %+v", msg)
+	}
+}
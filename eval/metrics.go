@@ -0,0 +1,173 @@
+package eval
+
+import (
+	"fmt"
+	"github.com/ielab/pecan"
+	"math"
+	"sort"
+)
+
+// DefaultCutoff is the rank that measures are cut off at when no cutoff is given.
+const DefaultCutoff = 10
+
+// Measures are the values of evaluation measures keyed by their name, e.g., "ndcg@10".
+type Measures map[string]float64
+
+// Results are the measures of each topic of a run, and their mean over the topics.
+type Results struct {
+	Topics map[string]Measures `json:"topics"`
+	Mean   Measures            `json:"mean"`
+}
+
+// messageLevel reports whether the judgements of a topic are of messages rather than conversations.
+func messageLevel(judged map[string]int) bool {
+	for item := range judged {
+		if _, err := pecan.ParseConversationID(item); err == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// Evaluate scores a run of conversations against qrels, cutting off measures at rank k.
+// Every topic in the qrels that has a relevant item is evaluated; topics the run has no conversations for score zero.
+//
+// Qrels may judge conversations, by their id, or messages. When messages are judged, a conversation has the
+// highest grade of the messages it contains, and the relevant messages are the units counted by recall and MAP,
+// so that a conversation containing several relevant messages is credited for each of them, but only once.
+// Message judgements also give the conversation-aware measures:
+//
+//   - ndcg_novel@k, nDCG where a conversation only gains from relevant messages that no higher ranked conversation contains.
+//   - message_precision@k, the fraction of the messages in the top k conversations that are relevant and not repeated.
+//   - message_recall@k, the fraction of relevant messages contained in the top k conversations.
+func Evaluate(qrels Qrels, run Run, k int) Results {
+	if k <= 0 {
+		k = DefaultCutoff
+	}
+	results := Results{Topics: make(map[string]Measures), Mean: make(Measures)}
+	counts := make(map[string]int)
+	for topic, judged := range qrels {
+		measures, ok := evaluateTopic(judged, run.Ranked[topic], run.Messages, k)
+		if !ok {
+			continue
+		}
+		results.Topics[topic] = measures
+		for name, value := range measures {
+			results.Mean[name] += value
+			counts[name]++
+		}
+	}
+	for name := range results.Mean {
+		results.Mean[name] /= float64(counts[name])
+	}
+	return results
+}
+
+// evaluateTopic computes the measures for a topic, and whether the topic has any relevant items.
+func evaluateTopic(judged map[string]int, ranked []string, messages map[string][]string, k int) (Measures, bool) {
+	// units are the ids of the relevant items of each conversation: the conversation itself, or its relevant messages.
+	byMessage := messageLevel(judged)
+	units := make([][]string, len(ranked))
+	for i, id := range ranked {
+		if !byMessage {
+			if judged[id] > 0 {
+				units[i] = []string{id}
+			}
+			continue
+		}
+		for _, m := range messages[id] {
+			if judged[m] > 0 {
+				units[i] = append(units[i], m)
+			}
+		}
+	}
+
+	var ideal []int
+	for _, grade := range judged {
+		if grade > 0 {
+			ideal = append(ideal, grade)
+		}
+	}
+	if len(ideal) == 0 {
+		return nil, false
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(ideal)))
+	numRelevant := float64(len(ideal))
+
+	var (
+		seen                  = make(map[string]bool)
+		relevantAtK, relevant float64
+		sumPrecision          float64
+		dcg, novelDCG         float64
+		messagesAtK, hitsAtK  float64
+		grades                []int
+	)
+	for i := range ranked {
+		discount := math.Log2(float64(i) + 2)
+		var grade, novelGrade, novel int
+		for _, u := range units[i] {
+			if judged[u] > grade {
+				grade = judged[u]
+			}
+			if !seen[u] {
+				seen[u] = true
+				novel++
+				if judged[u] > novelGrade {
+					novelGrade = judged[u]
+				}
+			}
+		}
+		if grade > 0 {
+			relevant++
+			grades = append(grades, grade)
+		}
+		// Precision is counted for each relevant unit when it is first retrieved.
+		sumPrecision += float64(novel) * relevant / float64(i+1)
+		if i < k {
+			dcg += float64(grade) / discount
+			novelDCG += float64(novelGrade) / discount
+			relevantAtK = relevant
+			hitsAtK += float64(novel)
+			messagesAtK += float64(len(messages[ranked[i]]))
+		}
+	}
+	// With message judgements, the ideal ranking for nDCG ranks the retrieved conversations together with
+	// a conversation for each relevant message that was not retrieved, while the ideal ranking for novel nDCG
+	// ranks the relevant messages, as each message can only be gained from once.
+	idealDCG := discountedGain(ideal, k)
+	conversationDCG := idealDCG
+	if byMessage {
+		for m, grade := range judged {
+			if grade > 0 && !seen[m] {
+				grades = append(grades, grade)
+			}
+		}
+		sort.Sort(sort.Reverse(sort.IntSlice(grades)))
+		conversationDCG = discountedGain(grades, k)
+	}
+
+	measures := Measures{
+		fmt.Sprintf("p@%d", k):    relevantAtK / float64(k),
+		fmt.Sprintf("ndcg@%d", k): dcg / conversationDCG,
+		"map":                     sumPrecision / numRelevant,
+		"recall":                  float64(len(seen)) / numRelevant,
+	}
+	if byMessage {
+		measures[fmt.Sprintf("ndcg_novel@%d", k)] = novelDCG / idealDCG
+		measures[fmt.Sprintf("message_recall@%d", k)] = hitsAtK / numRelevant
+		measures[fmt.Sprintf("message_precision@%d", k)] = 0
+		if messagesAtK > 0 {
+			measures[fmt.Sprintf("message_precision@%d", k)] = hitsAtK / messagesAtK
+		}
+	}
+	return measures, true
+}
+
+// discountedGain is the DCG of the first k grades of a ranking.
+func discountedGain(grades []int, k int) float64 {
+	var dcg float64
+	for i := 0; i < k && i < len(grades); i++ {
+		dcg += float64(grades[i]) / math.Log2(float64(i)+2)
+	}
+	return dcg
+}
@@ -0,0 +1,127 @@
+package eval
+
+import (
+	"github.com/ielab/pecan"
+	"math"
+	"testing"
+)
+
+// conversation is the id of a made up conversation in channel C1 starting at the second s.
+func conversation(s string) string {
+	return pecan.ConversationID{Channel: "C1", Start: s, End: s + ".5"}.String()
+}
+
+func TestEvaluate(t *testing.T) {
+	c1, c2, c3, c4, c5 := conversation("1"), conversation("2"), conversation("3"), conversation("4"), conversation("5")
+	// log3 is the discount of the second rank.
+	log3 := math.Log2(3)
+
+	tests := []struct {
+		name     string
+		judged   map[string]int
+		ranked   []string
+		messages map[string][]string
+		k        int
+		want     Measures
+	}{
+		{
+			// Ranks 1 and 3 are relevant with grades 2 and 1; a third relevant conversation is not retrieved.
+			name:   "graded conversations",
+			judged: map[string]int{c1: 2, c3: 1, c4: 0, c5: 1},
+			ranked: []string{c1, c2, c3, c4},
+			k:      3,
+			want: Measures{
+				"p@3":    2.0 / 3,
+				"ndcg@3": (2 + 1.0/2) / (2 + 1/log3 + 1.0/2),
+				"map":    (1.0/1 + 2.0/3) / 3,
+				"recall": 2.0 / 3,
+			},
+		},
+		{
+			name:   "nothing retrieved",
+			judged: map[string]int{c1: 1},
+			k:      10,
+			want:   Measures{"p@10": 0, "ndcg@10": 0, "map": 0, "recall": 0},
+		},
+		{
+			// The second conversation repeats m1, so it only gains from m4 once redundancy is penalised.
+			// m6 is relevant but in no retrieved conversation.
+			name:   "graded messages with repeats",
+			judged: map[string]int{"m1": 2, "m2": 2, "m3": 0, "m4": 1, "m6": 1},
+			ranked: []string{c1, c2, c3},
+			messages: map[string][]string{
+				c1: {"m1", "m2", "m3"},
+				c2: {"m1", "m4"},
+				c3: {"m5"},
+			},
+			k: 2,
+			want: Measures{
+				"p@2":                 2.0 / 2,
+				"ndcg@2":              (2 + 2/log3) / (2 + 2/log3),
+				"map":                 (2*1.0/1 + 1*2.0/2) / 4,
+				"recall":              3.0 / 4,
+				"ndcg_novel@2":        (2 + 1/log3) / (2 + 2/log3),
+				"message_recall@2":    3.0 / 4,
+				"message_precision@2": 3.0 / 5,
+			},
+		},
+		{
+			// Every relevant message is retrieved, but the top conversation has nothing relevant.
+			name:   "messages below the cutoff",
+			judged: map[string]int{"m1": 1},
+			ranked: []string{c3, c1},
+			messages: map[string][]string{
+				c1: {"m1", "m2"},
+				c3: {"m5"},
+			},
+			k: 1,
+			want: Measures{
+				"p@1":                 0,
+				"ndcg@1":              0,
+				"map":                 (1 * 1.0 / 2) / 1,
+				"recall":              1,
+				"ndcg_novel@1":        0,
+				"message_recall@1":    0,
+				"message_precision@1": 0,
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			run := Run{Ranked: map[string][]string{"1": test.ranked}, Messages: test.messages}
+			got := Evaluate(Qrels{"1": test.judged}, run, test.k).Topics["1"]
+			if len(got) != len(test.want) {
+				t.Errorf("measured %v, want %v", got, test.want)
+			}
+			for name, want := range test.want {
+				if value, ok := got[name]; !ok || math.Abs(value-want) > 1e-12 {
+					t.Errorf("%s = %v, want %v", name, value, want)
+				}
+			}
+		})
+	}
+}
+
+func TestEvaluateMean(t *testing.T) {
+	c1, c2 := conversation("1"), conversation("2")
+	qrels := Qrels{
+		"1": {c1: 1},
+		"2": {c2: 1},
+		// A topic without relevant items is left out rather than scoring zero.
+		"3": {c1: 0, c2: 0},
+	}
+	run := Run{Ranked: map[string][]string{"1": {c1}, "2": {c1, c2}, "3": {c1}}}
+	results := Evaluate(qrels, run, 0)
+	if _, ok := results.Topics["3"]; ok {
+		t.Error("evaluated a topic without relevant items")
+	}
+	if len(results.Topics) != 2 {
+		t.Errorf("evaluated %d topics, want 2", len(results.Topics))
+	}
+	if want := (1 + 1.0/2) / 2; math.Abs(results.Mean["map"]-want) > 1e-12 {
+		t.Errorf("mean map = %v, want %v", results.Mean["map"], want)
+	}
+	if want := (1 + 1/math.Log2(3)) / 2; math.Abs(results.Mean["ndcg@10"]-want) > 1e-12 {
+		t.Errorf("mean ndcg@10 = %v, want %v", results.Mean["ndcg@10"], want)
+	}
+}
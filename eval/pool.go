@@ -0,0 +1,123 @@
+package eval
+
+import (
+	"github.com/ielab/pecan"
+)
+
+// Run is the ranked item ids that a system retrieved for each topic.
+// For runs of conversations, Messages holds the ids of the messages in each conversation.
+type Run struct {
+	Name     string
+	Ranked   map[string][]string
+	Messages map[string][]string
+}
+
+// ConversationRun converts the conversations retrieved for each topic into a run over conversation ids.
+func ConversationRun(name string, conversations map[string][]pecan.Conversation) Run {
+	run := Run{Name: name, Ranked: make(map[string][]string), Messages: make(map[string][]string)}
+	for topic, ranked := range conversations {
+		ids := make([]string, len(ranked))
+		for i, c := range ranked {
+			ids[i] = c.ID().String()
+			messages := make([]string, len(c.Messages))
+			for j, m := range c.Messages {
+				messages[j] = m.Id
+			}
+			run.Messages[ids[i]] = messages
+		}
+		run.Ranked[topic] = ids
+	}
+	return run
+}
+
+// pooled collects the distinct items of a topic in the order they are added.
+type pooled struct {
+	items []string
+	seen  map[string]bool
+}
+
+func (p *pooled) add(item string) bool {
+	if p.seen[item] {
+		return false
+	}
+	p.seen[item] = true
+	p.items = append(p.items, item)
+	return true
+}
+
+func newPoolTopic(topic Topic, items []string) pecan.PoolTopic {
+	return pecan.PoolTopic{Id: topic.Id, Title: topic.Query, Description: topic.Description, Items: items}
+}
+
+// DepthPool pools the top depth items of every run for each topic. Items are added rank by rank,
+// taking the item at each rank from each run in turn, so that items retrieved highly come first.
+func DepthPool(topics []Topic, runs []Run, depth int) pecan.Pool {
+	var pool pecan.Pool
+	for _, topic := range topics {
+		p := pooled{seen: make(map[string]bool)}
+		for rank := 0; rank < depth; rank++ {
+			for _, run := range runs {
+				if ranked := run.Ranked[topic.Id]; rank < len(ranked) {
+					p.add(ranked[rank])
+				}
+			}
+		}
+		pool.Topics = append(pool.Topics, newPoolTopic(topic, p.items))
+	}
+	return pool
+}
+
+// BanditPool pools up to budget items for each topic by treating runs as the arms of a multi-armed bandit
+// (the MaxMean strategy of Losada et al., 2016): the next item always comes from the run whose items have so far
+// been most often relevant. The relevance of an item is its grade in qrels when it has been judged and otherwise
+// the fraction of runs that retrieved it, so that pools can be built before any judgements have been made.
+func BanditPool(topics []Topic, runs []Run, budget int, qrels Qrels) pecan.Pool {
+	var pool pecan.Pool
+	for _, topic := range topics {
+		votes := make(map[string]float64)
+		for _, run := range runs {
+			for _, item := range run.Ranked[topic.Id] {
+				votes[item]++
+			}
+		}
+		relevance := func(item string) float64 {
+			if grade, ok := qrels.Grade(topic.Id, item); ok {
+				if grade > 0 {
+					return 1
+				}
+				return 0
+			}
+			return votes[item] / float64(len(runs))
+		}
+
+		p := pooled{seen: make(map[string]bool)}
+		next := make([]int, len(runs))
+		relevant := make([]float64, len(runs))
+		pulled := make([]float64, len(runs))
+		for len(p.items) < budget {
+			arm := -1
+			var best float64
+			for i, run := range runs {
+				if next[i] >= len(run.Ranked[topic.Id]) {
+					continue
+				}
+				// The mean is smoothed with a uniform prior so that runs that have not been pulled are tried.
+				mean := (relevant[i] + 1) / (pulled[i] + 2)
+				if arm < 0 || mean > best {
+					arm, best = i, mean
+				}
+			}
+			if arm < 0 {
+				break
+			}
+			item := runs[arm].Ranked[topic.Id][next[arm]]
+			next[arm]++
+			// Items already in the pool still tell us about the run, but do not use up the budget.
+			relevant[arm] += relevance(item)
+			pulled[arm]++
+			p.add(item)
+		}
+		pool.Topics = append(pool.Topics, newPoolTopic(topic, p.items))
+	}
+	return pool
+}
@@ -0,0 +1,53 @@
+package eval
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Qrels are the grades of items keyed by topic and then item, as read from a TREC qrels file.
+type Qrels map[string]map[string]int
+
+// Grade is the grade of an item for a topic, and whether the item has been judged.
+func (q Qrels) Grade(topic, item string) (int, bool) {
+	grade, ok := q[topic][item]
+	return grade, ok
+}
+
+// ReadQrels reads qrels from the TREC qrels file at path.
+func ReadQrels(path string) (Qrels, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseQrels(f)
+}
+
+// ParseQrels parses lines of the form "topic iteration item grade".
+func ParseQrels(r io.Reader) (Qrels, error) {
+	qrels := make(Qrels)
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 4 {
+			return nil, fmt.Errorf("qrels line %d: expected 4 fields, got %d", n, len(fields))
+		}
+		grade, err := strconv.Atoi(fields[3])
+		if err != nil {
+			return nil, fmt.Errorf("qrels line %d: %w", n, err)
+		}
+		if _, ok := qrels[fields[0]]; !ok {
+			qrels[fields[0]] = make(map[string]int)
+		}
+		qrels[fields[0]][fields[2]] = grade
+	}
+	return qrels, scanner.Err()
+}
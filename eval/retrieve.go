@@ -0,0 +1,69 @@
+package eval
+
+import (
+	"context"
+	"fmt"
+	"github.com/ielab/pecan"
+	"sync"
+)
+
+// MaxConcurrentPipelines is the most pipelines that RetrievePipelines runs at once.
+const MaxConcurrentPipelines = 4
+
+// Retrieve runs each topic through the executor, retrieving the top depth conversations for it.
+// The query and any constraints of each topic are applied to the base request, and
+// pecan.ErrChannelForbidden is returned for a topic restricted to a channel that cannot be read.
+func Retrieve(ctx context.Context, exec *pecan.TaskExecutor, api pecan.ChatAPI, topics []Topic, base pecan.SearchRequest, depth int) (map[string][]pecan.Conversation, error) {
+	retrieved := make(map[string][]pecan.Conversation)
+	for _, topic := range topics {
+		request, err := topic.Request(base)
+		if err != nil {
+			return nil, err
+		}
+		if err := pecan.CheckChannelFilter(api, request); err != nil {
+			return nil, fmt.Errorf("topic %s: %w", topic.Id, err)
+		}
+		conversations, err := exec.GetTopConversations(ctx, api, request, depth)
+		if err != nil {
+			return nil, fmt.Errorf("topic %s: %w", topic.Id, err)
+		}
+		retrieved[topic.Id] = conversations
+	}
+	return retrieved, nil
+}
+
+// RetrievePipelines runs the topics through each of the named pipelines concurrently, at most
+// MaxConcurrentPipelines at a time, returning the conversations retrieved by each pipeline keyed by its name.
+// The first pipeline to fail cancels the others.
+func RetrievePipelines(ctx context.Context, exec *pecan.TaskExecutor, api pecan.ChatAPI, pipelines map[string]pecan.Pipeline, topics []Topic, base pecan.SearchRequest, depth int) (map[string]map[string][]pecan.Conversation, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var (
+		wg        sync.WaitGroup
+		mu        sync.Mutex
+		firstErr  error
+		running   = make(chan struct{}, MaxConcurrentPipelines)
+		retrieved = make(map[string]map[string][]pecan.Conversation)
+	)
+	for name, pipeline := range pipelines {
+		wg.Add(1)
+		go func(name string, pipeline pecan.Pipeline) {
+			defer wg.Done()
+			running <- struct{}{}
+			defer func() { <-running }()
+			conversations, err := Retrieve(ctx, exec.WithPipeline(pipeline), api, topics, base, depth)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				if firstErr == nil {
+					firstErr = fmt.Errorf("pipeline %s: %w", name, err)
+					cancel()
+				}
+				return
+			}
+			retrieved[name] = conversations
+		}(name, pipeline)
+	}
+	wg.Wait()
+	return retrieved, firstErr
+}
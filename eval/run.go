@@ -0,0 +1,122 @@
+package eval
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/hscells/trecresults"
+	"github.com/ielab/pecan"
+	"io"
+)
+
+// DefaultRunName is the name of runs when none is given.
+const DefaultRunName = "pecan"
+
+// Granularities of the items in a run, which should match the granularity that qrels were assessed at.
+const (
+	// ConversationGranularity has one result per conversation, identified by its conversation id.
+	// The messages of each conversation are listed in a sidecar written by WriteSidecar.
+	ConversationGranularity = "conversation"
+	// MessageGranularity has one result per message, in the order of the conversations they are in.
+	// Messages that are in more than one conversation are only ranked at their first.
+	MessageGranularity = "message"
+	// HitGranularity is like MessageGranularity, but only has the messages that matched the query.
+	HitGranularity = "hit"
+)
+
+// DefaultGranularity is the granularity of runs when none is given, which is one result per message,
+// as runs have always been.
+const DefaultGranularity = MessageGranularity
+
+var ErrUnknownGranularity = errors.New("unknown run granularity")
+
+// RunResults converts ranked conversations into TREC results at a granularity, ranked from 1.
+// Results are scored by their rank, from the number of results down to 1, because tools such as trec_eval order
+// results by score, and would otherwise reorder messages with the same score, or conversations whose scores are
+// not comparable across the pages they were retrieved on.
+func RunResults(topic, runName, granularity string, conversations []pecan.Conversation) (trecresults.ResultList, error) {
+	if len(runName) == 0 {
+		runName = DefaultRunName
+	}
+	if len(granularity) == 0 {
+		granularity = DefaultGranularity
+	}
+
+	var results trecresults.ResultList
+	switch granularity {
+	case ConversationGranularity:
+		for _, conversation := range conversations {
+			results = append(results, &trecresults.Result{DocId: conversation.ID().String()})
+		}
+	case MessageGranularity, HitGranularity:
+		seen := make(map[string]bool)
+		for _, conversation := range conversations {
+			for _, message := range conversation.Messages {
+				if seen[message.Id] || (granularity == HitGranularity && !message.Hit) {
+					continue
+				}
+				seen[message.Id] = true
+				results = append(results, &trecresults.Result{DocId: message.Id})
+			}
+		}
+	default:
+		return nil, ErrUnknownGranularity
+	}
+
+	for i, result := range results {
+		result.Score = float64(len(results) - i)
+		result.Topic = topic
+		result.Iteration = "0"
+		result.Rank = int64(i + 1)
+		result.RunName = runName
+	}
+	return results, nil
+}
+
+// WriteRun writes the conversations retrieved for each topic as a TREC run at a granularity, in the order of the topics.
+func WriteRun(w io.Writer, runName, granularity string, topics []Topic, retrieved map[string][]pecan.Conversation) error {
+	for _, topic := range topics {
+		results, err := RunResults(topic.Id, runName, granularity, retrieved[topic.Id])
+		if err != nil {
+			return err
+		}
+		b, err := results.Marshal()
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sidecarLine is a line of a sidecar, which lists the messages in a conversation of a run.
+type sidecarLine struct {
+	Id       string   `json:"id"`
+	Channel  string   `json:"channel"`
+	Messages []string `json:"messages"`
+}
+
+// WriteSidecar writes the ids of the messages in each conversation retrieved for the topics, with one JSON object per
+// conversation, so that runs at the conversation granularity can be related back to messages.
+func WriteSidecar(w io.Writer, topics []Topic, retrieved map[string][]pecan.Conversation) error {
+	enc := json.NewEncoder(w)
+	seen := make(map[string]bool)
+	for _, topic := range topics {
+		for _, conversation := range retrieved[topic.Id] {
+			id := conversation.ID()
+			if seen[id.String()] {
+				continue
+			}
+			seen[id.String()] = true
+			line := sidecarLine{Id: id.String(), Channel: id.Channel, Messages: make([]string, len(conversation.Messages))}
+			for i, m := range conversation.Messages {
+				line.Messages[i] = m.Id
+			}
+			if err := enc.Encode(line); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,364 @@
+package eval
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"sort"
+	"strings"
+)
+
+// Names of the significance tests that runs are compared with.
+const (
+	TTest         = "t-test"
+	Wilcoxon      = "wilcoxon"
+	Randomisation = "randomisation"
+	Bootstrap     = "bootstrap"
+)
+
+// SignificanceTests are the tests that every pair of runs is compared with, in the order they are reported.
+var SignificanceTests = []string{TTest, Wilcoxon, Randomisation, Bootstrap}
+
+// Corrections for comparing many pairs of runs at once.
+const (
+	NoCorrection = "none"
+	Bonferroni   = "bonferroni"
+	Holm         = "holm"
+)
+
+// DefaultTrials is the number of trials of the randomisation and bootstrap tests when none is given.
+const DefaultTrials = 10000
+
+var ErrUnknownCorrection = errors.New("unknown correction")
+
+// Comparison is the difference between two runs on a measure over the topics they share,
+// and the p-value of each significance test before and after correction.
+type Comparison struct {
+	A          string             `json:"a"`
+	B          string             `json:"b"`
+	Topics     int                `json:"topics"`
+	MeanA      float64            `json:"mean_a"`
+	MeanB      float64            `json:"mean_b"`
+	Difference float64            `json:"difference"`
+	PValues    map[string]float64 `json:"p_values"`
+	Adjusted   map[string]float64 `json:"adjusted_p_values"`
+}
+
+// ComparisonTable compares every pair of runs on a measure.
+type ComparisonTable struct {
+	Measure     string       `json:"measure"`
+	Correction  string       `json:"correction"`
+	Trials      int          `json:"trials"`
+	Comparisons []Comparison `json:"comparisons"`
+}
+
+// Compare tests whether each pair of runs differs on a measure, using the per-topic measures of the runs.
+// Every topic that a pair of runs share must have the measure, so that a misspelled measure is an error.
+// The p-values of each test are corrected for the number of pairs compared. The randomisation and bootstrap
+// tests use the given number of trials and a fixed seed, so that comparisons can be reproduced.
+func Compare(results map[string]Results, measure, correction string, trials int) (ComparisonTable, error) {
+	if len(correction) == 0 {
+		correction = Holm
+	}
+	if correction != NoCorrection && correction != Bonferroni && correction != Holm {
+		return ComparisonTable{}, ErrUnknownCorrection
+	}
+	if trials <= 0 {
+		trials = DefaultTrials
+	}
+	table := ComparisonTable{Measure: measure, Correction: correction, Trials: trials}
+
+	names := make([]string, 0, len(results))
+	for name := range results {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for i := range names {
+		for j := i + 1; j < len(names); j++ {
+			a, b := results[names[i]], results[names[j]]
+			var topics []string
+			for topic := range a.Topics {
+				if _, ok := b.Topics[topic]; ok {
+					topics = append(topics, topic)
+				}
+			}
+			sort.Strings(topics)
+			if len(topics) == 0 {
+				return table, fmt.Errorf("runs %s and %s have no topics in common", names[i], names[j])
+			}
+
+			c := Comparison{A: names[i], B: names[j], Topics: len(topics), PValues: make(map[string]float64)}
+			differences := make([]float64, len(topics))
+			for k, topic := range topics {
+				x, ok := a.Topics[topic][measure]
+				if !ok {
+					return table, fmt.Errorf("run %s has no measure %s for topic %s", names[i], measure, topic)
+				}
+				y, ok := b.Topics[topic][measure]
+				if !ok {
+					return table, fmt.Errorf("run %s has no measure %s for topic %s", names[j], measure, topic)
+				}
+				c.MeanA += x
+				c.MeanB += y
+				differences[k] = x - y
+			}
+			n := float64(len(topics))
+			c.MeanA /= n
+			c.MeanB /= n
+			c.Difference = c.MeanA - c.MeanB
+
+			rng := rand.New(rand.NewSource(1))
+			c.PValues[TTest] = pairedTTest(differences)
+			c.PValues[Wilcoxon] = wilcoxonSignedRank(differences)
+			c.PValues[Randomisation] = randomisationTest(differences, trials, rng)
+			c.PValues[Bootstrap] = bootstrapTest(differences, trials, rng)
+			table.Comparisons = append(table.Comparisons, c)
+		}
+	}
+
+	for _, test := range SignificanceTests {
+		p := make([]float64, len(table.Comparisons))
+		for i, c := range table.Comparisons {
+			p[i] = c.PValues[test]
+		}
+		adjusted := correct(p, correction)
+		for i := range table.Comparisons {
+			if table.Comparisons[i].Adjusted == nil {
+				table.Comparisons[i].Adjusted = make(map[string]float64)
+			}
+			table.Comparisons[i].Adjusted[test] = adjusted[i]
+		}
+	}
+	return table, nil
+}
+
+// correct adjusts p-values for the number of hypotheses tested.
+func correct(p []float64, correction string) []float64 {
+	m := float64(len(p))
+	adjusted := make([]float64, len(p))
+	switch correction {
+	case Bonferroni:
+		for i := range p {
+			adjusted[i] = math.Min(1, p[i]*m)
+		}
+	case Holm:
+		order := make([]int, len(p))
+		for i := range order {
+			order[i] = i
+		}
+		sort.SliceStable(order, func(i, j int) bool {
+			return p[order[i]] < p[order[j]]
+		})
+		// Adjusted p-values are kept monotone so that a hypothesis is never rejected after one that is not.
+		var max float64
+		for rank, i := range order {
+			v := math.Min(1, p[i]*(m-float64(rank)))
+			max = math.Max(max, v)
+			adjusted[i] = max
+		}
+	default:
+		copy(adjusted, p)
+	}
+	return adjusted
+}
+
+func mean(x []float64) float64 {
+	var sum float64
+	for _, v := range x {
+		sum += v
+	}
+	return sum / float64(len(x))
+}
+
+// pairedTTest is the two-sided p-value of a paired t-test on the differences between two runs.
+// A single topic gives no evidence of a difference, as its variance cannot be estimated.
+func pairedTTest(differences []float64) float64 {
+	n := float64(len(differences))
+	if n < 2 {
+		return 1
+	}
+	m := mean(differences)
+	var ss float64
+	for _, d := range differences {
+		ss += (d - m) * (d - m)
+	}
+	if ss == 0 {
+		if m == 0 {
+			return 1
+		}
+		return 0
+	}
+	t := m / math.Sqrt(ss/(n-1)/n)
+	df := n - 1
+	return regularisedIncompleteBeta(df/(df+t*t), df/2, 0.5)
+}
+
+// wilcoxonSignedRank is the two-sided p-value of the Wilcoxon signed-rank test on the differences between two runs,
+// using the normal approximation with corrections for ties and continuity. Differences of zero are discarded.
+func wilcoxonSignedRank(differences []float64) float64 {
+	var nonZero []float64
+	for _, d := range differences {
+		if d != 0 {
+			nonZero = append(nonZero, d)
+		}
+	}
+	n := float64(len(nonZero))
+	if n == 0 {
+		return 1
+	}
+	sort.Slice(nonZero, func(i, j int) bool {
+		return math.Abs(nonZero[i]) < math.Abs(nonZero[j])
+	})
+
+	var w, ties float64
+	for i := 0; i < len(nonZero); {
+		j := i
+		for j < len(nonZero) && math.Abs(nonZero[j]) == math.Abs(nonZero[i]) {
+			j++
+		}
+		// Tied differences share the average of the ranks they span.
+		rank := float64(i+j+1) / 2
+		for k := i; k < j; k++ {
+			if nonZero[k] > 0 {
+				w += rank
+			}
+		}
+		t := float64(j - i)
+		ties += t*t*t - t
+		i = j
+	}
+
+	mu := n * (n + 1) / 4
+	sigma := math.Sqrt(n*(n+1)*(2*n+1)/24 - ties/48)
+	if sigma == 0 {
+		return 1
+	}
+	z := math.Max(0, math.Abs(w-mu)-0.5) / sigma
+	return math.Erfc(z / math.Sqrt2)
+}
+
+// randomisationTest is the two-sided p-value of a paired randomisation test, which randomly swaps
+// the scores of the runs on each topic to see how often a difference at least as large arises by chance.
+func randomisationTest(differences []float64, trials int, rng *rand.Rand) float64 {
+	observed := math.Abs(mean(differences))
+	var count int
+	for t := 0; t < trials; t++ {
+		var sum float64
+		for _, d := range differences {
+			if rng.Intn(2) == 0 {
+				sum += d
+			} else {
+				sum -= d
+			}
+		}
+		if math.Abs(sum/float64(len(differences))) >= observed-1e-12 {
+			count++
+		}
+	}
+	return float64(count+1) / float64(trials+1)
+}
+
+// bootstrapTest is the two-sided p-value of a paired bootstrap test, which resamples topics from the differences
+// shifted to have a mean of zero, to see how often a difference at least as large arises when there is none.
+// A single topic gives no evidence of a difference, as every resample of it is the same.
+func bootstrapTest(differences []float64, trials int, rng *rand.Rand) float64 {
+	n := len(differences)
+	if n < 2 {
+		return 1
+	}
+	m := mean(differences)
+	observed := math.Abs(m)
+	var count int
+	for t := 0; t < trials; t++ {
+		var sum float64
+		for i := 0; i < n; i++ {
+			sum += differences[rng.Intn(n)] - m
+		}
+		if math.Abs(sum/float64(n)) >= observed-1e-12 {
+			count++
+		}
+	}
+	return float64(count+1) / float64(trials+1)
+}
+
+// regularisedIncompleteBeta is I_x(a, b), evaluated with a continued fraction.
+func regularisedIncompleteBeta(x, a, b float64) float64 {
+	if x <= 0 {
+		return 0
+	}
+	if x >= 1 {
+		return 1
+	}
+	la, _ := math.Lgamma(a)
+	lb, _ := math.Lgamma(b)
+	lab, _ := math.Lgamma(a + b)
+	front := math.Exp(lab - la - lb + a*math.Log(x) + b*math.Log(1-x))
+	// The continued fraction converges quickly only on one side of the mean of the distribution.
+	if x < (a+1)/(a+b+2) {
+		return front * betaContinuedFraction(x, a, b) / a
+	}
+	return 1 - front*betaContinuedFraction(1-x, b, a)/b
+}
+
+func betaContinuedFraction(x, a, b float64) float64 {
+	const (
+		maxIterations = 300
+		epsilon       = 1e-14
+		tiny          = 1e-300
+	)
+	c, d := 1.0, 1-(a+b)*x/(a+1)
+	if math.Abs(d) < tiny {
+		d = tiny
+	}
+	d = 1 / d
+	h := d
+	for m := 1; m <= maxIterations; m++ {
+		fm := float64(m)
+		for _, num := range []float64{
+			fm * (b - fm) * x / ((a + 2*fm - 1) * (a + 2*fm)),
+			-(a + fm) * (a + b + fm) * x / ((a + 2*fm) * (a + 2*fm + 1)),
+		} {
+			d = 1 + num*d
+			if math.Abs(d) < tiny {
+				d = tiny
+			}
+			c = 1 + num/c
+			if math.Abs(c) < tiny {
+				c = tiny
+			}
+			d = 1 / d
+			h *= d * c
+		}
+		if math.Abs(d*c-1) < epsilon {
+			break
+		}
+	}
+	return h
+}
+
+// WriteMarkdown writes the comparisons as a Markdown table of corrected p-values.
+func (t ComparisonTable) WriteMarkdown(w io.Writer) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Comparison of %s (%s correction)\n\n", t.Measure, t.Correction)
+	b.WriteString("| A | B | Topics | Mean A | Mean B | Difference |")
+	for _, test := range SignificanceTests {
+		fmt.Fprintf(&b, " %s |", test)
+	}
+	b.WriteString("\n|---|---|---:|---:|---:|---:|")
+	for range SignificanceTests {
+		b.WriteString("---:|")
+	}
+	b.WriteString("\n")
+	for _, c := range t.Comparisons {
+		fmt.Fprintf(&b, "| %s | %s | %d | %.4f | %.4f | %+.4f |", c.A, c.B, c.Topics, c.MeanA, c.MeanB, c.Difference)
+		for _, test := range SignificanceTests {
+			fmt.Fprintf(&b, " %.4f |", c.Adjusted[test])
+		}
+		b.WriteString("\n")
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
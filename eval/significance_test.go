@@ -0,0 +1,185 @@
+package eval
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+func TestRegularisedIncompleteBeta(t *testing.T) {
+	tests := []struct {
+		name    string
+		x, a, b float64
+		want    float64
+	}{
+		{"symmetric", 0.5, 3.5, 3.5, 0.5},
+		{"a of one", 0.3, 1, 4, 1 - math.Pow(0.7, 4)},
+		{"b of one", 0.3, 2.5, 1, math.Pow(0.3, 2.5)},
+		{"zero", 0, 2, 3, 0},
+		{"one", 1, 2, 3, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := regularisedIncompleteBeta(test.x, test.a, test.b); math.Abs(got-test.want) > 1e-12 {
+				t.Errorf("I_%v(%v, %v) = %v, want %v", test.x, test.a, test.b, got, test.want)
+			}
+		})
+	}
+
+	// The two-sided p-values of the critical values of Student's t-distribution.
+	critical := []struct {
+		t, df, p float64
+	}{
+		{12.706204736174707, 1, 0.05},
+		{2.570581835636314, 5, 0.05},
+		{3.169272667175838, 10, 0.01},
+		{2.042272456301238, 30, 0.05},
+		{2.749995653567574, 30, 0.01},
+	}
+	for _, c := range critical {
+		if got := regularisedIncompleteBeta(c.df/(c.df+c.t*c.t), c.df/2, 0.5); math.Abs(got-c.p) > 1e-9 {
+			t.Errorf("p(t = %v, df = %v) = %v, want %v", c.t, c.df, got, c.p)
+		}
+	}
+}
+
+func TestPairedTTest(t *testing.T) {
+	tests := []struct {
+		name        string
+		differences []float64
+		want        float64
+	}{
+		// With one and two degrees of freedom, the p-value of t is 1 - 2/π atan(|t|) and 1 - |t|/√(2 + t²).
+		{"one degree of freedom", []float64{1, 3}, 1 - 2/math.Pi*math.Atan(2)},
+		{"two degrees of freedom", []float64{1, 2, 3}, 1 - 2*math.Sqrt(3)/math.Sqrt(14)},
+		{"negative differences", []float64{-1, -2, -3}, 1 - 2*math.Sqrt(3)/math.Sqrt(14)},
+		{"all zero", []float64{0, 0, 0}, 1},
+		{"one topic", []float64{0.3}, 1},
+		{"constant", []float64{0.3, 0.3, 0.3}, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := pairedTTest(test.differences); math.Abs(got-test.want) > 1e-12 {
+				t.Errorf("p = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestWilcoxonSignedRank(t *testing.T) {
+	tests := []struct {
+		name        string
+		differences []float64
+		want        float64
+	}{
+		// W+ = 1 + 3 + 4 + 5 = 13, the mean is 5·6/4 = 7.5, and the variance is 5·6·11/24 = 13.75.
+		{"no ties", []float64{1, -2, 3, 4, 5}, math.Erfc((13 - 7.5 - 0.5) / math.Sqrt(13.75) / math.Sqrt2)},
+		// The zero is discarded, the two pairs of ties have ranks 1.5 and 3.5 so W+ = 1.5 + 1.5 + 3.5 + 5 = 11.5,
+		// and each pair lowers the variance by (2³ - 2)/48.
+		{"ties", []float64{1, 1, -2, 2, 3, 0}, math.Erfc((11.5 - 7.5 - 0.5) / math.Sqrt(13.75-12.0/48) / math.Sqrt2)},
+		{"all zero", []float64{0, 0, 0}, 1},
+		// W+ = 1 is within the continuity correction of its mean, 0.5.
+		{"one topic", []float64{0.3}, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := wilcoxonSignedRank(test.differences); math.Abs(got-test.want) > 1e-12 {
+				t.Errorf("p = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+// The randomisation and bootstrap tests are compared with their exact p-values, found by enumerating every
+// sign flip or resample, within three standard errors of an estimate from DefaultTrials trials.
+func TestResamplingTests(t *testing.T) {
+	tolerance := func(p float64) float64 {
+		return 3*math.Sqrt(p*(1-p)/DefaultTrials) + 1.0/DefaultTrials
+	}
+	tests := []struct {
+		name          string
+		differences   []float64
+		randomisation float64
+		bootstrap     float64
+	}{
+		// Only flipping none or all of the signs gives a mean as large, and no resample of the differences
+		// shifted to [-2, -1, 0, 1, 2] has a mean as far as 3 from zero.
+		{"consistent", []float64{1, 2, 3, 4, 5}, 2.0 / 32, 0},
+		// Shifted to [-1, -1, 2], a resample with k twos has a sum of 3k - 3, which is at least 3 apart from
+		// zero when k is 0, 2, or 3: (8 + 6 + 1)/27.
+		{"skewed", []float64{0, 0, 3}, 1, 15.0 / 27},
+		{"all zero", []float64{0, 0, 0}, 1, 1},
+		{"one topic", []float64{0.3}, 1, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rng := rand.New(rand.NewSource(1))
+			if got := randomisationTest(test.differences, DefaultTrials, rng); math.Abs(got-test.randomisation) > tolerance(test.randomisation) {
+				t.Errorf("randomisation p = %v, want %v", got, test.randomisation)
+			}
+			if got := bootstrapTest(test.differences, DefaultTrials, rng); math.Abs(got-test.bootstrap) > tolerance(test.bootstrap) {
+				t.Errorf("bootstrap p = %v, want %v", got, test.bootstrap)
+			}
+		})
+	}
+}
+
+func TestCorrect(t *testing.T) {
+	p := []float64{0.01, 0.04, 0.03, 0.005}
+	tests := []struct {
+		correction string
+		p          []float64
+		want       []float64
+	}{
+		{NoCorrection, p, p},
+		{Bonferroni, p, []float64{0.04, 0.16, 0.12, 0.02}},
+		// Sorted, the p-values are multiplied by 4, 3, 2, and 1, and 0.04 is raised to the 0.06 before it.
+		{Holm, p, []float64{0.03, 0.06, 0.06, 0.02}},
+		{Bonferroni, []float64{0.5, 0.6}, []float64{1, 1}},
+		{Holm, []float64{0.5, 0.6}, []float64{1, 1}},
+		{Holm, []float64{0.02}, []float64{0.02}},
+	}
+	for _, test := range tests {
+		got := correct(test.p, test.correction)
+		for i := range test.want {
+			if math.Abs(got[i]-test.want[i]) > 1e-12 {
+				t.Errorf("%s of %v = %v, want %v", test.correction, test.p, got, test.want)
+				break
+			}
+		}
+	}
+}
+
+func TestHolmMonotone(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for trial := 0; trial < 100; trial++ {
+		p := make([]float64, 1+rng.Intn(20))
+		for i := range p {
+			// Some p-values are rounded so that there are ties.
+			p[i] = rng.Float64() / 4
+			if rng.Intn(3) == 0 {
+				p[i] = math.Round(p[i]*100) / 100
+			}
+		}
+		adjusted := correct(p, Holm)
+		order := make([]int, len(p))
+		for i := range order {
+			order[i] = i
+		}
+		sort.Slice(order, func(i, j int) bool {
+			return p[order[i]] < p[order[j]]
+		})
+		for k := 1; k < len(order); k++ {
+			i, j := order[k-1], order[k]
+			if adjusted[i] > adjusted[j] {
+				t.Fatalf("p = %v is adjusted to %v, above the %v that p = %v is adjusted to", p[i], adjusted[i], adjusted[j], p[j])
+			}
+		}
+		for i := range p {
+			if adjusted[i] < p[i] || adjusted[i] > 1 {
+				t.Fatalf("p = %v is adjusted to %v", p[i], adjusted[i])
+			}
+		}
+	}
+}
@@ -0,0 +1,136 @@
+// Package eval builds and scores test collections for the conversations that pecan retrieves.
+package eval
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/ielab/pecan"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Topic is an information need, searched for with its query.
+// From, To, and Channel optionally restrict the messages searched for the topic.
+type Topic struct {
+	Id          string `json:"id"`
+	Query       string `json:"query"`
+	Description string `json:"description,omitempty"`
+	From        string `json:"from,omitempty"`
+	To          string `json:"to,omitempty"`
+	Channel     string `json:"channel,omitempty"`
+}
+
+// Request is the search request for the topic, starting from the base request.
+func (t Topic) Request(base pecan.SearchRequest) (pecan.SearchRequest, error) {
+	request := base
+	request.Query = t.Query
+	var err error
+	if len(t.From) > 0 {
+		request.From, err = time.Parse(pecan.DateFormat, t.From)
+		if err != nil {
+			return request, fmt.Errorf("topic %s: %w", t.Id, err)
+		}
+	}
+	if len(t.To) > 0 {
+		request.To, err = time.Parse(pecan.DateFormat, t.To)
+		if err != nil {
+			return request, fmt.Errorf("topic %s: %w", t.Id, err)
+		}
+	}
+	if len(t.Channel) > 0 {
+		request.Channel = t.Channel
+	}
+	request.SetDefaultDates()
+	return request, nil
+}
+
+// ReadTopics reads topics from the file at path, as parsed by ParseTopics.
+func ReadTopics(path string) ([]Topic, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseTopics(bytes.NewReader(b))
+}
+
+// ParseTopics parses topics either in the TREC format, where each topic is enclosed in <top> tags,
+// or as one JSON object per line.
+func ParseTopics(r io.Reader) ([]Topic, error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.HasPrefix(bytes.TrimSpace(b), []byte("<top>")) {
+		return parseTopicsTREC(string(b))
+	}
+	return parseTopicsJSONL(bytes.NewReader(b))
+}
+
+func parseTopicsJSONL(r io.Reader) ([]Topic, error) {
+	var topics []Topic
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+		var topic Topic
+		if err := json.Unmarshal(scanner.Bytes(), &topic); err != nil {
+			return nil, err
+		}
+		topics = append(topics, topic)
+	}
+	return topics, scanner.Err()
+}
+
+var (
+	trecTopic = regexp.MustCompile(`(?s)<top>(.*?)</top>`)
+	trecField = regexp.MustCompile(`(?s)<(num|title|desc|narr|from|to|channel)>(.*?)(?:<(?:num|title|desc|narr|from|to|channel)>|$)`)
+	// trecLabel matches the labels that conventionally start the text of a field, e.g., "Number:".
+	trecLabel = regexp.MustCompile(`^(Number|Description|Narrative):`)
+	trecClose = regexp.MustCompile(`</[a-z]+>`)
+)
+
+// parseTopicsTREC parses topics in the TREC format. The title of a topic is its query. Topics may
+// also contain <from>, <to>, and <channel> fields to restrict the messages searched.
+func parseTopicsTREC(s string) ([]Topic, error) {
+	var topics []Topic
+	for _, top := range trecTopic.FindAllStringSubmatch(s, -1) {
+		var topic Topic
+		body := top[1]
+		for len(body) > 0 {
+			loc := trecField.FindStringSubmatchIndex(body)
+			if loc == nil {
+				break
+			}
+			tag := body[loc[2]:loc[3]]
+			value := trecClose.ReplaceAllString(body[loc[4]:loc[5]], "")
+			value = trecLabel.ReplaceAllString(strings.TrimSpace(value), "")
+			value = strings.Join(strings.Fields(value), " ")
+			switch tag {
+			case "num":
+				topic.Id = value
+			case "title":
+				topic.Query = value
+			case "desc":
+				topic.Description = value
+			case "from":
+				topic.From = value
+			case "to":
+				topic.To = value
+			case "channel":
+				topic.Channel = value
+			}
+			body = body[loc[5]:]
+		}
+		if len(topic.Id) == 0 {
+			return nil, fmt.Errorf("topic %d has no number", len(topics)+1)
+		}
+		topics = append(topics, topic)
+	}
+	return topics, nil
+}
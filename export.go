@@ -0,0 +1,213 @@
+package pecan
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// ExportFormat writes conversations to a file that can be downloaded.
+type ExportFormat struct {
+	ContentType string
+	Extension   string
+	Write       func(w io.Writer, start int, conversations []Conversation) error
+}
+
+// ExportFormats are the formats that conversations can be exported as, keyed by the value of the export parameter.
+var ExportFormats = map[string]ExportFormat{
+	"jsonl": {ContentType: "application/x-ndjson", Extension: "jsonl", Write: exportJSONLines},
+	"csv":   {ContentType: "text/csv", Extension: "csv", Write: exportCSV},
+	"md":    {ContentType: "text/markdown", Extension: "md", Write: exportMarkdown},
+	"html":  {ContentType: "text/html", Extension: "html", Write: exportHTML},
+}
+
+// exportText is the text of a message, falling back to the text of a deleted message.
+func exportText(m Message) string {
+	if len(m.Text) == 0 && m.PreviousMessage != nil {
+		return m.PreviousMessage.Text
+	}
+	return m.Text
+}
+
+// exportUser is the user of a message, falling back to the user of a deleted message.
+func exportUser(m Message) string {
+	if len(m.User) == 0 && m.PreviousMessage != nil {
+		return m.PreviousMessage.User
+	}
+	return m.User
+}
+
+// csvCell prefixes text that a spreadsheet would otherwise evaluate as a formula with a quote.
+func csvCell(s string) string {
+	if len(s) > 0 && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
+
+// markdownSpecial are the characters that Markdown treats as formatting.
+const markdownSpecial = "\\`*_{}[]()<>#+-.!|~"
+
+// escapeMarkdown escapes the characters of text that Markdown would otherwise treat as formatting.
+func escapeMarkdown(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune(markdownSpecial, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+type exportedMessage struct {
+	Id        string  `json:"id"`
+	Timestamp string  `json:"ts"`
+	Time      string  `json:"time"`
+	User      string  `json:"user"`
+	Text      string  `json:"text"`
+	Score     float64 `json:"score"`
+	Hit       bool    `json:"hit"`
+}
+
+type exportedConversation struct {
+	Id          string            `json:"id"`
+	Rank        int               `json:"rank"`
+	Score       float64           `json:"score"`
+	Channel     string            `json:"channel"`
+	ChannelName string            `json:"channel_name"`
+	Messages    []exportedMessage `json:"messages"`
+}
+
+func exportConversation(rank int, c Conversation) exportedConversation {
+	e := exportedConversation{
+		Id:       c.ID().String(),
+		Rank:     rank,
+		Score:    c.Score,
+		Messages: make([]exportedMessage, len(c.Messages)),
+	}
+	if len(c.Messages) > 0 {
+		e.Channel = c.Messages[0].Channel
+		e.ChannelName = c.Messages[0].ChannelName
+	}
+	for i, m := range c.Messages {
+		e.Messages[i] = exportedMessage{
+			Id:        m.Id,
+			Timestamp: m.Timestamp,
+			Time:      m.EventTimestamp,
+			User:      exportUser(m),
+			Text:      exportText(m),
+			Score:     m.Score,
+			Hit:       m.Hit,
+		}
+	}
+	return e
+}
+
+// exportJSONLines writes one JSON object per conversation.
+func exportJSONLines(w io.Writer, start int, conversations []Conversation) error {
+	enc := json.NewEncoder(w)
+	for i, c := range conversations {
+		if err := enc.Encode(exportConversation(start+i+1, c)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// exportCSV writes one row per message, repeating the details of the conversation the message is in.
+func exportCSV(w io.Writer, start int, conversations []Conversation) error {
+	cw := csv.NewWriter(w)
+	err := cw.Write([]string{"conversation_id", "rank", "conversation_score", "channel", "channel_name", "message_id", "ts", "time", "user", "hit", "score", "text"})
+	if err != nil {
+		return err
+	}
+	for i, c := range conversations {
+		e := exportConversation(start+i+1, c)
+		for _, m := range e.Messages {
+			err := cw.Write([]string{
+				e.Id,
+				strconv.Itoa(e.Rank),
+				strconv.FormatFloat(e.Score, 'g', -1, 64),
+				csvCell(e.Channel),
+				csvCell(e.ChannelName),
+				csvCell(m.Id),
+				m.Timestamp,
+				m.Time,
+				csvCell(m.User),
+				strconv.FormatBool(m.Hit),
+				strconv.FormatFloat(m.Score, 'g', -1, 64),
+				csvCell(m.Text),
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// exportMarkdown writes a transcript of each conversation, with messages that matched the query in bold.
+// Names and text are escaped so that they cannot change the layout of the transcript.
+func exportMarkdown(w io.Writer, start int, conversations []Conversation) error {
+	for i, c := range conversations {
+		e := exportConversation(start+i+1, c)
+		_, err := fmt.Fprintf(w, "## %d. #%s (score %g)\n\n", e.Rank, escapeMarkdown(e.ChannelName), e.Score)
+		if err != nil {
+			return err
+		}
+		for _, m := range e.Messages {
+			text := strings.ReplaceAll(escapeMarkdown(m.Text), "\n", "  \n  ")
+			if m.Hit {
+				text = "**" + text + "**"
+			}
+			_, err := fmt.Fprintf(w, "- _%s_ **%s**: %s\n", escapeMarkdown(m.Time), escapeMarkdown(m.User), text)
+			if err != nil {
+				return err
+			}
+		}
+		if _, err := fmt.Fprintln(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var exportHTMLTemplate = template.Must(template.New("export").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="UTF-8">
+<title>PECAN Conversations</title>
+<style>
+body { font-family: sans-serif; max-width: 50em; margin: 2em auto; }
+article { border: 1px solid #ddd; border-radius: .3em; padding: 1em; margin-bottom: 1em; }
+.time { color: #aaaaaa; }
+.hit { border-left: 3px solid #0074d9; padding-left: .5em; background: #f5faff; }
+</style>
+</head>
+<body>
+{{ range . }}
+<article>
+<h3>{{ .Rank }}. #{{ .ChannelName }} <small>(score {{ .Score }})</small></h3>
+{{ range .Messages }}
+<p{{ if .Hit }} class="hit"{{ end }}><span class="time">{{ .Time }}</span> <b>{{ .User }}</b> {{ .Text }}</p>
+{{ end }}
+</article>
+{{ end }}
+</body>
+</html>
+`))
+
+// exportHTML writes a standalone page containing the conversations.
+func exportHTML(w io.Writer, start int, conversations []Conversation) error {
+	exported := make([]exportedConversation, len(conversations))
+	for i, c := range conversations {
+		exported[i] = exportConversation(start+i+1, c)
+	}
+	return exportHTMLTemplate.Execute(w, exported)
+}
@@ -0,0 +1,53 @@
+package pecan
+
+import (
+	"bytes"
+	"encoding/csv"
+	"strings"
+	"testing"
+)
+
+// untrusted is a conversation whose names and text look like spreadsheet formulas and Markdown formatting.
+var untrusted = []Conversation{{Score: 1, Messages: []Message{
+	{Id: "m1", Channel: "C1", ChannelName: "=chan", User: "@bob", Text: "=HYPERLINK(\"http://evil\")", Timestamp: "1615256000.000100"},
+	{Id: "m2", Channel: "C1", ChannelName: "=chan", User: "-carol", Text: "# heading\n* [link](http://evil) <b>", Timestamp: "1615256001.000100"},
+	{Id: "m3", Channel: "C1", ChannelName: "=chan", User: "dave", Text: "plain text", Timestamp: "1615256002.000100"},
+}}}
+
+func TestExportCSVFormulas(t *testing.T) {
+	var buf bytes.Buffer
+	if err := exportCSV(&buf, 0, untrusted); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 4 {
+		t.Fatalf("wrote %d rows", len(rows))
+	}
+	for _, row := range rows[1:] {
+		for _, cell := range row {
+			if len(cell) > 0 && strings.ContainsRune("=+@", rune(cell[0])) {
+				t.Errorf("cell %q would be evaluated as a formula", cell)
+			}
+		}
+	}
+	if rows[1][4] != "'=chan" || rows[1][8] != "'@bob" || rows[2][8] != "'-carol" || rows[3][11] != "plain text" {
+		t.Errorf("wrote %v", rows[1:])
+	}
+}
+
+func TestExportMarkdownEscaping(t *testing.T) {
+	var buf bytes.Buffer
+	if err := exportMarkdown(&buf, 0, untrusted); err != nil {
+		t.Fatal(err)
+	}
+	want := "## 1. #=chan (score 1)\n\n" +
+		"- __ **@bob**: =HYPERLINK\\(\"http://evil\"\\)\n" +
+		"- __ **\\-carol**: \\# heading  \n  \\* \\[link\\]\\(http://evil\\) \\<b\\>\n" +
+		"- __ **dave**: plain text\n\n"
+	if got := buf.String(); got != want {
+		t.Errorf("wrote\n%s\nwant\n%s", got, want)
+	}
+}
@@ -0,0 +1,101 @@
+package pecan
+
+import (
+	"context"
+	"fmt"
+	"github.com/olivere/elastic/v7"
+	"time"
+)
+
+// FacetSize is the default maximum number of values computed for the channel and user facets.
+const FacetSize = 10
+
+// Facet is a single value of a facet and the number of messages that contain it.
+type Facet struct {
+	Value string `json:"value"`
+	Name  string `json:"name"`
+	Count int64  `json:"count"`
+}
+
+// MonthFacet is a calendar month and the number of messages sent within it.
+type MonthFacet struct {
+	Name  string `json:"name"`
+	From  string `json:"from"`
+	To    string `json:"to"`
+	Count int64  `json:"count"`
+}
+
+type Facets struct {
+	Channels []Facet      `json:"channels"`
+	Users    []Facet      `json:"users"`
+	Months   []MonthFacet `json:"months"`
+}
+
+// monthRanges splits the period of a search request into calendar months.
+func monthRanges(request SearchRequest) [][2]time.Time {
+	var ranges [][2]time.Time
+	to := request.To.Add(24 * time.Hour)
+	for start := time.Date(request.From.Year(), request.From.Month(), 1, 0, 0, 0, 0, time.UTC); start.Before(to); start = start.AddDate(0, 1, 0) {
+		ranges = append(ranges, [2]time.Time{start, start.AddDate(0, 1, 0)})
+	}
+	return ranges
+}
+
+// queryFacets computes the channel, user, and month facets of the messages matching a search request.
+// Months are computed as ranges rather than a date histogram so that they do not depend on how ts is mapped.
+func queryFacets(es *elastic.Client, ctx context.Context, channels []string, request SearchRequest) (*elastic.SearchResult, error) {
+	months := elastic.NewRangeAggregation().Field("ts")
+	for _, r := range monthRanges(request) {
+		months = months.AddRangeWithKey(r[0].Format(DateFormat), r[0].Unix(), r[1].Unix())
+	}
+	size := request.FacetSize
+	if size <= 0 {
+		size = FacetSize
+	}
+	return es.Search(request.Index).
+		Query(buildSearchQuery(channels, request)).
+		Size(0).
+		Aggregation("channels", elastic.NewTermsAggregation().Field("channel").Size(size)).
+		Aggregation("users", elastic.NewTermsAggregation().Field("user").Size(size)).
+		Aggregation("months", months).
+		Do(ctx)
+}
+
+// convertSearchResponseToFacets maps the aggregations of a facet query into facets,
+// leaving ids for channels and users unresolved.
+func convertSearchResponseToFacets(resp *elastic.SearchResult) Facets {
+	var facets Facets
+	if resp == nil {
+		return facets
+	}
+	if agg, ok := resp.Aggregations.Terms("channels"); ok {
+		for _, bucket := range agg.Buckets {
+			value := fmt.Sprint(bucket.Key)
+			facets.Channels = append(facets.Channels, Facet{Value: value, Name: value, Count: bucket.DocCount})
+		}
+	}
+	if agg, ok := resp.Aggregations.Terms("users"); ok {
+		for _, bucket := range agg.Buckets {
+			value := fmt.Sprint(bucket.Key)
+			facets.Users = append(facets.Users, Facet{Value: value, Name: value, Count: bucket.DocCount})
+		}
+	}
+	if agg, ok := resp.Aggregations.Range("months"); ok {
+		for _, bucket := range agg.Buckets {
+			if bucket.DocCount == 0 {
+				continue
+			}
+			from, err := time.Parse(DateFormat, bucket.Key)
+			if err != nil {
+				continue
+			}
+			facets.Months = append(facets.Months, MonthFacet{
+				Name:  from.Format("January 2006"),
+				From:  from.Format(DateFormat),
+				To:    from.AddDate(0, 1, -1).Format(DateFormat),
+				Count: bucket.DocCount,
+			})
+		}
+	}
+	return facets
+}
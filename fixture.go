@@ -0,0 +1,220 @@
+package pecan
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Modes of a FixtureTransport.
+const (
+	FixtureRecord = "record"
+	FixtureReplay = "replay"
+)
+
+// fixtureEntry is a line of a fixture file: a request made to elasticsearch, the date it was made on, and its response.
+type fixtureEntry struct {
+	Date     string `json:"date,omitempty"`
+	Method   string `json:"method"`
+	Path     string `json:"path"`
+	Query    string `json:"query,omitempty"`
+	Body     string `json:"body,omitempty"`
+	Status   int    `json:"status"`
+	Response string `json:"response"`
+}
+
+func (e fixtureEntry) key() string {
+	return e.Method + " " + e.Path + "?" + e.Query + "\n" + e.Body
+}
+
+// FixtureTransport records the requests made to elasticsearch and their responses to a fixture file,
+// or replays the responses from a fixture file without elasticsearch, so that experiments can be reproduced
+// without the exact index they were run on. Requests are matched on their method, path, query, and body, so
+// replayed requests must be made with the same parameters as when they were recorded. Requests that search until
+// today by default are replayed as if it were still the day the fixture was recorded on, see RecordedOn.
+// A request that was not recorded receives an error response that names it. When the same request was
+// recorded several times, e.g., to open a point in time, its responses are replayed in the order they were
+// recorded, repeating the last. A transport that records must be closed once it is no longer used.
+type FixtureTransport struct {
+	sync.Mutex
+	mode      string
+	transport http.RoundTripper
+	file      *os.File
+	responses map[string][]fixtureEntry
+	replayed  map[string]int
+	recorded  time.Time
+}
+
+// NewFixtureTransport creates a transport that records to or replays from the fixture at path.
+// Recording replaces any existing fixture, and sends requests using transport.
+func NewFixtureTransport(mode, path string, transport http.RoundTripper) (*FixtureTransport, error) {
+	t := &FixtureTransport{
+		mode:      mode,
+		transport: transport,
+		responses: make(map[string][]fixtureEntry),
+		replayed:  make(map[string]int),
+	}
+	switch mode {
+	case FixtureRecord:
+		f, err := os.Create(path)
+		if err != nil {
+			return nil, err
+		}
+		t.file = f
+	case FixtureReplay:
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), 256*1024*1024)
+		for scanner.Scan() {
+			var e fixtureEntry
+			if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+				return nil, err
+			}
+			if t.recorded.IsZero() && len(e.Date) > 0 {
+				if t.recorded, err = time.Parse(DateFormat, e.Date); err != nil {
+					return nil, err
+				}
+			}
+			t.responses[e.key()] = append(t.responses[e.key()], e)
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown fixture mode %q", mode)
+	}
+	return t, nil
+}
+
+// Close closes the fixture being recorded. Closing a transport that replays does nothing.
+func (t *FixtureTransport) Close() error {
+	t.Lock()
+	defer t.Unlock()
+	if t.file == nil {
+		return nil
+	}
+	err := t.file.Close()
+	t.file = nil
+	return err
+}
+
+// RecordedOn is the date that the replayed fixture was recorded on, if it is known.
+func (t *FixtureTransport) RecordedOn() (time.Time, bool) {
+	return t.recorded, !t.recorded.IsZero()
+}
+
+// canonicalBody formats JSON bodies consistently so that equivalent requests match.
+func canonicalBody(b []byte) string {
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return string(b)
+	}
+	c, err := json.Marshal(v)
+	if err != nil {
+		return string(b)
+	}
+	return string(c)
+}
+
+func (t *FixtureTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	entry := fixtureEntry{
+		Method: req.Method,
+		Path:   req.URL.Path,
+		Query:  req.URL.Query().Encode(),
+	}
+	if req.Body != nil {
+		b, err := ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		entry.Body = canonicalBody(b)
+		req.Body = ioutil.NopCloser(bytes.NewReader(b))
+	}
+
+	if t.mode == FixtureReplay {
+		return t.replay(req, entry)
+	}
+
+	resp, err := t.transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(b))
+	entry.Date = today().Format(DateFormat)
+	entry.Status = resp.StatusCode
+	entry.Response = string(b)
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return nil, err
+	}
+	t.Lock()
+	defer t.Unlock()
+	if _, err := t.file.Write(append(line, '\n')); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (t *FixtureTransport) replay(req *http.Request, entry fixtureEntry) (*http.Response, error) {
+	t.Lock()
+	key := entry.key()
+	recorded, ok := t.responses[key]
+	if !ok {
+		t.Unlock()
+		return missingFixture(req, key)
+	}
+	i := t.replayed[key]
+	if i < len(recorded)-1 {
+		t.replayed[key]++
+	}
+	t.Unlock()
+	return fixtureResponse(req, recorded[i]), nil
+}
+
+// missingFixture is the response to a request that was not recorded. It is an elasticsearch error, rather than
+// a failure to send the request, so that it is not retried and the key of the request is reported.
+func missingFixture(req *http.Request, key string) (*http.Response, error) {
+	b, err := json.Marshal(map[string]interface{}{
+		"error": map[string]interface{}{
+			"type":   "fixture_missing_exception",
+			"reason": "no recorded response for " + key,
+		},
+		"status": http.StatusNotImplemented,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return fixtureResponse(req, fixtureEntry{Status: http.StatusNotImplemented, Response: string(b)}), nil
+}
+
+// fixtureResponse is the response recorded in a fixture entry.
+func fixtureResponse(req *http.Request, e fixtureEntry) *http.Response {
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", e.Status, http.StatusText(e.Status)),
+		StatusCode:    e.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": []string{"application/json; charset=UTF-8"}},
+		Body:          ioutil.NopCloser(bytes.NewReader([]byte(e.Response))),
+		ContentLength: int64(len(e.Response)),
+		Request:       req,
+	}
+}
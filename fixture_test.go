@@ -0,0 +1,77 @@
+package pecan
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const fixtureSearchResponse = `{"took":1,"hits":{"total":{"value":1,"relation":"eq"},"hits":[{"_index":"pecan","_id":"m1","_score":1.5,"_source":{"channel":"C1","user":"U1","text":"hello","ts":"1615256000.000100","event_ts":"1615256000.000100"},"sort":[1.5,1615256000,"m1"]}]}}`
+
+func fixtureConfig(t *testing.T, mode, path, url string) *Config {
+	t.Helper()
+	config := new(Config)
+	config.Elasticsearch.Url = url
+	config.Elasticsearch.Index = "pecan"
+	config.Elasticsearch.Fixture.Mode = mode
+	config.Elasticsearch.Fixture.Path = path
+	return config
+}
+
+// TestFixtureReplay records a search that runs until today, and replays it on a later day.
+func TestFixtureReplay(t *testing.T) {
+	defer func(now func() time.Time) { today = now }(today)
+	recordedOn := time.Date(2021, 3, 9, 15, 0, 0, 0, time.UTC)
+	today = func() time.Time { return recordedOn }
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if strings.HasSuffix(r.URL.Path, "/_search") {
+			_, _ = w.Write([]byte(fixtureSearchResponse))
+			return
+		}
+		_, _ = w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+
+	path := filepath.Join(t.TempDir(), "fixture.jsonl")
+	search := func(config *Config, query string) ([]Message, error) {
+		es, fixture, err := NewElasticClient(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer fixture.Close()
+		request := SearchRequest{Query: query, Index: config.Elasticsearch.Index}
+		request.SetDefaultDates()
+		return NewNoChatAPI().GetMessages(es, context.Background(), request)
+	}
+
+	recorded, err := search(fixtureConfig(t, FixtureRecord, path, server.URL), "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Close()
+
+	// Replaying the next day must search until the day the fixture was recorded on.
+	today = func() time.Time { return recordedOn.Add(48 * time.Hour) }
+	replay := fixtureConfig(t, FixtureReplay, path, server.URL)
+	replayed, err := search(replay, "hello")
+	if err != nil {
+		t.Fatalf("replaying the next day: %v", err)
+	}
+	if len(replayed) != 1 || replayed[0].Id != recorded[0].Id {
+		t.Errorf("replayed %v, recorded %v", replayed, recorded)
+	}
+
+	_, err = search(replay, "goodbye")
+	if err == nil {
+		t.Fatal("replayed a request that was not recorded")
+	}
+	if !strings.Contains(err.Error(), "no recorded response for POST /pecan/_search") || !strings.Contains(err.Error(), "goodbye") {
+		t.Errorf("error does not name the missing request: %v", err)
+	}
+}
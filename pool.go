@@ -0,0 +1,52 @@
+package pecan
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+)
+
+// PoolTopic is a topic and the items that should be assessed for it.
+// Items are either conversation ids, as encoded by ConversationID.String, or message ids.
+type PoolTopic struct {
+	Id          string   `json:"id"`
+	Title       string   `json:"title"`
+	Description string   `json:"description,omitempty"`
+	Items       []string `json:"items"`
+}
+
+// Pool is the set of items to assess for each topic of a test collection, loaded from a JSON file.
+type Pool struct {
+	Topics []PoolTopic `json:"topics"`
+}
+
+// Grade is a level of relevance that an item can be judged as.
+type Grade struct {
+	Value int    `json:"value"`
+	Label string `json:"label"`
+}
+
+// DefaultGrades are the grades used when none are configured.
+var DefaultGrades = []Grade{
+	{Value: 0, Label: "Not relevant"},
+	{Value: 1, Label: "Partially relevant"},
+	{Value: 2, Label: "Relevant"},
+}
+
+// ReadPool loads a pool from the JSON file at path.
+func ReadPool(path string) (Pool, error) {
+	var pool Pool
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return pool, err
+	}
+	err = json.Unmarshal(b, &pool)
+	return pool, err
+}
+
+// WritePool writes a pool as JSON that can be read by ReadPool.
+func WritePool(w io.Writer, pool Pool) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(pool)
+}
@@ -2,6 +2,9 @@ package pecan
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
 	"github.com/olivere/elastic/v7"
 	"sort"
 )
@@ -41,10 +44,93 @@ func (exec *TaskExecutor) SetScoreFunc(scoreFunc ScoreFunc) *TaskExecutor {
 	return exec
 }
 
+// Pipeline names the bounds, aggregate, and score functions used to retrieve conversations,
+// as understood by MustMapBoundFunc, MustMapAggregateFunc, and MustMapScoreFunc.
+type Pipeline struct {
+	Bounder    string `json:"bounder,omitempty"`
+	Aggregator string `json:"aggregator,omitempty"`
+	Scorer     string `json:"scorer,omitempty"`
+}
+
+// PipelineKey is the key in the gin context of a Pipeline that should be used for that request only.
+const PipelineKey = "pecan.pipeline"
+
+// WithPipeline creates a copy of the executor that uses the functions named by the pipeline.
+func (exec *TaskExecutor) WithPipeline(pipeline Pipeline) *TaskExecutor {
+	return NewTaskExecutor(exec.api, exec.es).
+		SetBoundsFunc(MustMapBoundFunc(pipeline.Bounder)).
+		SetAggregateFunc(MustMapAggregateFunc(pipeline.Aggregator)).
+		SetScoreFunc(MustMapScoreFunc(pipeline.Scorer))
+}
+
+// ForRequest returns the executor to use for a request, which uses the pipeline
+// set in the gin context when there is one, and otherwise is the executor itself.
+func (exec *TaskExecutor) ForRequest(c *gin.Context) *TaskExecutor {
+	if v, ok := c.Get(PipelineKey); ok {
+		if pipeline, ok := v.(Pipeline); ok {
+			return exec.WithPipeline(pipeline)
+		}
+	}
+	return exec
+}
+
+// PageFunc retrieves a page of ranked conversations for a request.
+type PageFunc func(ctx context.Context, api ChatAPI, request SearchRequest) (ConversationPage, error)
+
+// PageFuncKey is the key in the gin context of a PageFunc that should be used for that request only,
+// e.g., to interleave the rankings of several pipelines.
+const PageFuncKey = "pecan.page"
+
+// PageFuncForRequest returns the function that retrieves the page of conversations for a request,
+// which is the one set in the gin context when there is one, and otherwise GetConversationPage of ForRequest.
+func (exec *TaskExecutor) PageFuncForRequest(c *gin.Context) PageFunc {
+	if v, ok := c.Get(PageFuncKey); ok {
+		if f, ok := v.(PageFunc); ok {
+			return f
+		}
+	}
+	return exec.ForRequest(c).GetConversationPage
+}
+
 func (exec *TaskExecutor) GetMessages(ctx context.Context, request SearchRequest) ([]Message, error) {
 	return exec.api.GetMessages(exec.es, ctx, request)
 }
 
+// boundConversation forms the conversation that surrounds a message using the bounds function.
+func (exec *TaskExecutor) boundConversation(ctx context.Context, api ChatAPI, message Message, request SearchRequest) (Conversation, error) {
+	conversation, err := exec.BoundsFunc(exec.es, api, ctx, message.Channel, message, request)
+	if err != nil {
+		return Conversation{}, err
+	}
+	// Mark the message that originated the conversation so it can be distinguished from its context.
+	for j := range conversation {
+		if conversation[j].Id == message.Id {
+			conversation[j].Hit = true
+			conversation[j].Highlight = message.Highlight
+		}
+	}
+	return Conversation{
+		Score:    0,
+		Messages: conversation,
+	}, nil
+}
+
+// rankConversations merges, scores, and then sorts conversations by their score.
+func (exec *TaskExecutor) rankConversations(conversations []Conversation) ([]Conversation, error) {
+	merged, err := exec.AggregateFunc(conversations)
+	if err != nil {
+		return nil, err
+	}
+	scored, err := exec.ScoreFunc(merged)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(scored, func(i, j int) bool {
+		return scored[i].Score > scored[j].Score
+	})
+	return scored, nil
+}
+
 func (exec *TaskExecutor) GetConversations(ctx context.Context, api ChatAPI, request SearchRequest) ([]Conversation, error) {
 	messages, err := exec.GetMessages(ctx, request)
 	if err != nil {
@@ -52,47 +138,245 @@ func (exec *TaskExecutor) GetConversations(ctx context.Context, api ChatAPI, req
 	}
 	var conversations []Conversation
 	for i := range messages {
-		conversation, err := exec.BoundsFunc(exec.es, api, ctx, messages[i].Channel, messages[i], request)
+		conversation, err := exec.boundConversation(ctx, api, messages[i], request)
 		if err != nil {
 			return nil, err
 		}
-		conversations = append(conversations, Conversation{
-			Score:    0,
-			Messages: conversation,
-		})
+		conversations = append(conversations, conversation)
 	}
 
-	merged, err := exec.AggregateFunc(conversations)
+	return exec.rankConversations(conversations)
+}
+
+// GetRecentConversations retrieves the conversations surrounding the most recently sent messages,
+// ordered from the most recent conversation.
+func (exec *TaskExecutor) GetRecentConversations(ctx context.Context, api ChatAPI, request SearchRequest) ([]Conversation, error) {
+	// Without a query, every message matches equally and messages are ranked by time.
+	request.Query = ""
+	messages, err := exec.GetMessages(ctx, request)
 	if err != nil {
 		return nil, err
 	}
-	scored, err := exec.ScoreFunc(merged)
+	if len(messages) > RecentSize {
+		messages = messages[:RecentSize]
+	}
+	var conversations []Conversation
+	for i := range messages {
+		conversation, err := exec.boundConversation(ctx, api, messages[i], request)
+		if err != nil {
+			return nil, err
+		}
+		conversations = append(conversations, conversation)
+	}
+
+	merged, err := exec.AggregateFunc(conversations)
 	if err != nil {
 		return nil, err
 	}
-	sort.Slice(scored, func(i, j int) bool {
-		return scored[i].Score > scored[j].Score
+	sort.SliceStable(merged, func(i, j int) bool {
+		return merged[i].Messages[len(merged[i].Messages)-1].Timestamp > merged[j].Messages[len(merged[j].Messages)-1].Timestamp
 	})
+	return merged, nil
+}
 
-	return scored, nil
+// ConversationPage is a page of ranked conversations and the cursors of the page and the pages around it.
+// Next and Prev are empty when there is no such page.
+type ConversationPage struct {
+	Conversations []Conversation
+	Start         int
+	Cursor        string
+	Next          string
+	Prev          string
 }
 
+// GetConversationPage retrieves the page of conversations at the cursor of the request.
+// Hits are consumed in rank order until they would form more conversations than fit on the page,
+// so that each hit contributes to exactly one page no matter how conversations are merged.
+// Every page of a search is retrieved from the same point in time, which is opened for the first page and
+// closed once the last page is reached. ErrCursorExpired is returned for a cursor whose point in time has
+// expired or been closed, since its sort values cannot be resumed from any other.
+func (exec *TaskExecutor) GetConversationPage(ctx context.Context, api ChatAPI, request SearchRequest) (ConversationPage, error) {
+	cursor, err := DecodeCursor(request.Cursor)
+	if err != nil {
+		return ConversationPage{}, err
+	}
+	size := request.Size
+	if size <= 0 {
+		size = ConversationsPerPage
+	}
+	if len(cursor.PIT) == 0 {
+		cursor.PIT, err = openPointInTime(exec.es, ctx, request.Index)
+		if err != nil {
+			return ConversationPage{}, err
+		}
+	}
+	request.PIT = cursor.PIT
+
+	var (
+		conversations []Conversation
+		after         = cursor.After()
+		full          bool
+	)
+	for !full {
+		request.After = after
+		messages, err := exec.GetMessages(ctx, request)
+		if elastic.IsNotFound(err) {
+			// The sort values of the cursor only make sense in the point in time they came from.
+			return ConversationPage{}, ErrCursorExpired
+		}
+		if err != nil {
+			return ConversationPage{}, err
+		}
+		for i := range messages {
+			conversation, err := exec.boundConversation(ctx, api, messages[i], request)
+			if err != nil {
+				return ConversationPage{}, err
+			}
+			candidate := append(conversations[:len(conversations):len(conversations)], conversation)
+			merged, err := exec.AggregateFunc(candidate)
+			if err != nil {
+				return ConversationPage{}, err
+			}
+			if len(merged) > size {
+				full = true
+				break
+			}
+			conversations = candidate
+			after = messages[i].Sort
+		}
+		if len(messages) < SearchSize {
+			break
+		}
+	}
+
+	ranked, err := exec.rankConversations(conversations)
+	if err != nil {
+		return ConversationPage{}, err
+	}
+	page := ConversationPage{
+		Conversations: ranked,
+		Start:         cursor.Start(),
+		Cursor:        cursor.Encode(),
+	}
+	if full {
+		page.Next = cursor.Next(after, cursor.Start()+len(ranked)).Encode()
+	} else if err := exec.ClosePointInTime(ctx, cursor.PIT); err != nil {
+		return ConversationPage{}, err
+	}
+	if prev, ok := cursor.Prev(); ok {
+		page.Prev = prev.Encode()
+	}
+	return page, nil
+}
+
+// GetTopConversations pages through the ranked conversations for a request from the first page until depth
+// conversations have been retrieved, or there are no more. Every page is retrieved from the same point in time,
+// which is closed once they have been, so that the ranking is consistent even while messages are being indexed.
+func (exec *TaskExecutor) GetTopConversations(ctx context.Context, api ChatAPI, request SearchRequest, depth int) (conversations []Conversation, err error) {
+	pit, err := openPointInTime(exec.es, ctx, request.Index)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if closeErr := exec.ClosePointInTime(ctx, pit); err == nil && closeErr != nil {
+			conversations, err = nil, closeErr
+		}
+	}()
+
+	request.Cursor = Cursor{PIT: pit}.Encode()
+	for {
+		page, err := exec.GetConversationPage(ctx, api, request)
+		if err != nil {
+			return nil, err
+		}
+		conversations = append(conversations, page.Conversations...)
+		if len(page.Next) == 0 || len(conversations) >= depth {
+			break
+		}
+		request.Cursor = page.Next
+	}
+
+	if len(conversations) > depth {
+		conversations = conversations[:depth]
+	}
+	return conversations, nil
+}
+
+// ClosePointInTime closes a point in time once no more pages will be retrieved from it.
+// A point in time that has already expired or been closed is not an error.
+func (exec *TaskExecutor) ClosePointInTime(ctx context.Context, pit string) error {
+	_, err := exec.es.ClosePointInTime(pit).Do(ctx)
+	if elastic.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// ErrUnknownFunction is returned for a pipeline that names a function which does not exist.
+var ErrUnknownFunction = errors.New("unknown function")
+
+// The functions that pipelines can name, and the name of the one used when a pipeline does not name one.
+var (
+	BoundsFuncs    = map[string]BoundsFunc{"time": TimeBounder}
+	AggregateFuncs = map[string]AggregateFunc{"time": TimeAggregator}
+	ScoreFuncs     = map[string]ScoreFunc{"message": MessageScorer}
+)
+
+const (
+	DefaultBounder    = "time"
+	DefaultAggregator = "time"
+	DefaultScorer     = "message"
+)
+
+// Canonical names the functions of the pipeline the same way however they were named, filling in the
+// defaults, so that two pipelines are equal exactly when they use the same functions.
+// ErrUnknownFunction is returned when it names a function that is not in BoundsFuncs, AggregateFuncs, or ScoreFuncs.
+func (pipeline Pipeline) Canonical() (Pipeline, error) {
+	canonical := func(kind, name, defaultName string, exists bool) (string, error) {
+		if len(name) == 0 {
+			return defaultName, nil
+		}
+		if !exists {
+			return "", fmt.Errorf("%w: %s %q", ErrUnknownFunction, kind, name)
+		}
+		return name, nil
+	}
+	var err error
+	_, ok := BoundsFuncs[pipeline.Bounder]
+	if pipeline.Bounder, err = canonical("bounder", pipeline.Bounder, DefaultBounder, ok); err != nil {
+		return Pipeline{}, err
+	}
+	_, ok = AggregateFuncs[pipeline.Aggregator]
+	if pipeline.Aggregator, err = canonical("aggregator", pipeline.Aggregator, DefaultAggregator, ok); err != nil {
+		return Pipeline{}, err
+	}
+	_, ok = ScoreFuncs[pipeline.Scorer]
+	if pipeline.Scorer, err = canonical("scorer", pipeline.Scorer, DefaultScorer, ok); err != nil {
+		return Pipeline{}, err
+	}
+	return pipeline, nil
+}
+
+// MustMapBoundFunc returns the bounds function in BoundsFuncs with the name, or the default one.
 func MustMapBoundFunc(name string) BoundsFunc {
-	switch name {
-	default:
-		return TimeBounder
+	if f, ok := BoundsFuncs[name]; ok {
+		return f
 	}
+	return BoundsFuncs[DefaultBounder]
 }
 
+// MustMapAggregateFunc returns the aggregate function in AggregateFuncs with the name, or the default one.
 func MustMapAggregateFunc(name string) AggregateFunc {
-	switch name {
-	default:
-		return TimeAggregator
+	if f, ok := AggregateFuncs[name]; ok {
+		return f
 	}
+	return AggregateFuncs[DefaultAggregator]
 }
+
+// MustMapScoreFunc returns the score function in ScoreFuncs with the name, or the default one.
 func MustMapScoreFunc(name string) ScoreFunc {
-	switch name {
-	default:
-		return MessageScorer
+	if f, ok := ScoreFuncs[name]; ok {
+		return f
 	}
+	return ScoreFuncs[DefaultScorer]
 }
@@ -0,0 +1,214 @@
+package pecan
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Kinds of token store that can be configured.
+const (
+	MemoryTokens = "memory"
+	FileTokens   = "file"
+)
+
+// DefaultTokenExpiry is how long access tokens are kept when the config does not say.
+const DefaultTokenExpiry = 7 * 24 * time.Hour
+
+var ErrTokenNotFound = errors.New("token not found")
+
+// TokenStore keeps the access tokens of logged in users, keyed by the token stored in their session.
+// Implementations must be safe to use from many requests at once.
+type TokenStore interface {
+	// Get returns the access token for a session token, or ErrTokenNotFound if it was never stored,
+	// has expired, or was revoked.
+	Get(token string) (string, error)
+	// Put stores the access token for a session token until it expires.
+	Put(token, accessToken string) error
+	// Revoke removes the access token for a session token.
+	Revoke(token string) error
+}
+
+// storedToken is an access token and when it expires.
+type storedToken struct {
+	AccessToken string    `json:"access_token"`
+	Expires     time.Time `json:"expires"`
+}
+
+// MemoryTokenStore keeps access tokens in memory, so users must log in again when pecan restarts.
+type MemoryTokenStore struct {
+	sync.RWMutex
+	expiry time.Duration
+	tokens map[string]storedToken
+}
+
+func NewMemoryTokenStore(expiry time.Duration) *MemoryTokenStore {
+	if expiry <= 0 {
+		expiry = DefaultTokenExpiry
+	}
+	return &MemoryTokenStore{
+		expiry: expiry,
+		tokens: make(map[string]storedToken),
+	}
+}
+
+func (s *MemoryTokenStore) Get(token string) (string, error) {
+	s.RLock()
+	defer s.RUnlock()
+	t, ok := s.tokens[token]
+	if !ok || time.Now().After(t.Expires) {
+		return "", ErrTokenNotFound
+	}
+	return t.AccessToken, nil
+}
+
+func (s *MemoryTokenStore) Put(token, accessToken string) error {
+	s.Lock()
+	defer s.Unlock()
+	s.put(token, accessToken)
+	return nil
+}
+
+func (s *MemoryTokenStore) Revoke(token string) error {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.tokens, token)
+	return nil
+}
+
+// put stores an access token and forgets any that have expired. The caller must hold the lock.
+func (s *MemoryTokenStore) put(token, accessToken string) {
+	now := time.Now()
+	for k, t := range s.tokens {
+		if now.After(t.Expires) {
+			delete(s.tokens, k)
+		}
+	}
+	s.tokens[token] = storedToken{AccessToken: accessToken, Expires: now.Add(s.expiry)}
+}
+
+// FileTokenStore keeps access tokens in memory and in a file, so that users stay logged in when pecan restarts.
+// The file is encrypted with AES-GCM using a key derived from a secret, e.g., the cookie secret, and is rewritten
+// whenever a token is stored or revoked.
+type FileTokenStore struct {
+	*MemoryTokenStore
+	path string
+	aead cipher.AEAD
+}
+
+// NewFileTokenStore opens the token store at path, which is created when it is first written to.
+func NewFileTokenStore(path, secret string, expiry time.Duration) (*FileTokenStore, error) {
+	if len(secret) == 0 {
+		return nil, errors.New("a secret is required to encrypt tokens")
+	}
+	key := sha256.Sum256([]byte("pecan tokens\x00" + secret))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	s := &FileTokenStore{
+		MemoryTokenStore: NewMemoryTokenStore(expiry),
+		path:             path,
+		aead:             aead,
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < aead.NonceSize() {
+		return nil, fmt.Errorf("token store %s is corrupt", path)
+	}
+	plaintext, err := aead.Open(nil, b[:aead.NonceSize()], b[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, fmt.Errorf("token store %s could not be decrypted, has the secret changed? %v", path, err)
+	}
+	if err := json.Unmarshal(plaintext, &s.tokens); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *FileTokenStore) Put(token, accessToken string) error {
+	s.Lock()
+	defer s.Unlock()
+	s.put(token, accessToken)
+	return s.save()
+}
+
+func (s *FileTokenStore) Revoke(token string) error {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.tokens, token)
+	return s.save()
+}
+
+// save encrypts the tokens into a temporary file that then replaces the store, so that it is never left half written.
+// The caller must hold the lock.
+func (s *FileTokenStore) save() error {
+	plaintext, err := json.Marshal(s.tokens)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return err
+	}
+	b := s.aead.Seal(nonce, nonce, plaintext, nil)
+
+	f, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), s.path)
+}
+
+// NewTokenStore creates the token store described by the config.
+func NewTokenStore(config *Config) (TokenStore, error) {
+	expiry := DefaultTokenExpiry
+	if len(config.Tokens.Expiry) > 0 {
+		var err error
+		expiry, err = time.ParseDuration(config.Tokens.Expiry)
+		if err != nil {
+			return nil, err
+		}
+	}
+	switch config.Tokens.Store {
+	case "", MemoryTokens:
+		return NewMemoryTokenStore(expiry), nil
+	case FileTokens:
+		path := config.Tokens.Path
+		if len(path) == 0 {
+			path = "pecan-tokens"
+		}
+		return NewFileTokenStore(path, config.Secrets.Cookie, expiry)
+	default:
+		return nil, fmt.Errorf("unknown token store %q", config.Tokens.Store)
+	}
+}
@@ -1,13 +1,47 @@
 package pecan
 
 import (
+	"errors"
 	"github.com/gin-gonic/gin"
+	"net/http"
+	"strconv"
+	"strings"
 	"time"
 )
 
 const DateFormat = "2006-01-02"
 const ElasticDateFormat = "yyyy-MM-dd"
 const SearchSize = 50
+const ConversationsPerPage = 10
+
+// RecentSize is the number of recently sent messages that conversations are shown for on the homepage.
+const RecentSize = 10
+
+// ActivityDays is the number of days that channel activity is computed over on the homepage.
+const ActivityDays = 30
+
+// APIPath is the path that the versioned JSON API is served under.
+const APIPath = "/api/v1"
+
+// ErrNotLoggedIn is returned to requests to the JSON API that are not from a logged in user.
+var ErrNotLoggedIn = errors.New("you are not logged in")
+
+// ErrorPage renders a page explaining why a request could not be completed.
+func ErrorPage(c *gin.Context, code int, title, message string) {
+	c.HTML(code, "error.html", gin.H{"Title": title, "Message": message})
+	c.Abort()
+}
+
+// RequireLogin turns away a request that is not from a logged in user. Requests to the JSON API
+// receive ErrNotLoggedIn with a 401, and those for pages are redirected to the login page.
+func RequireLogin(c *gin.Context) {
+	if strings.HasPrefix(c.Request.URL.Path, APIPath+"/") {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, ErrorResponse{Error: ErrNotLoggedIn.Error()})
+		return
+	}
+	c.Redirect(http.StatusFound, "/login")
+	c.Abort()
+}
 
 type SearchResponseType int
 
@@ -22,18 +56,73 @@ type SearchResponse struct {
 	Query         string
 	From          string
 	To            string
-	Next          int
-	Prev          int
+	Start         int
+	Cursor        string
+	Next          string
+	Prev          string
 	Took          time.Duration
 	Messages      []Message
 	Conversations []Conversation
 	PrevNext      int
+	Channel       string
+	User          string
+	Facets        Facets
+	NumMessages   int64
+}
+
+type ConversationResponse struct {
+	Conversation Conversation
+	From         string
+	To           string
+}
+
+// LoginResponse is the login page, with the token that the local login form posts back.
+type LoginResponse struct {
+	*Config
+	LoginToken string
 }
 
 type StatisticsResponse struct {
-	NumMessages int64
-	From        string
-	To          string
+	NumMessages int64  `json:"num_messages"`
+	From        string `json:"from"`
+	To          string `json:"to"`
+}
+
+// ConversationsResponse is the JSON representation of a page of conversations.
+type ConversationsResponse struct {
+	Query         string         `json:"query"`
+	From          string         `json:"from"`
+	To            string         `json:"to"`
+	Channel       string         `json:"channel,omitempty"`
+	User          string         `json:"user,omitempty"`
+	Start         int            `json:"start"`
+	Cursor        string         `json:"cursor"`
+	Next          string         `json:"next,omitempty"`
+	Prev          string         `json:"prev,omitempty"`
+	Conversations []Conversation `json:"conversations"`
+	Facets        Facets         `json:"facets"`
+}
+
+// MessagesResponse is the JSON representation of messages retrieved around a message.
+type MessagesResponse struct {
+	Channel  string    `json:"channel"`
+	PrevNext int       `json:"prev_next"`
+	Messages []Message `json:"messages"`
+}
+
+// ChannelsResponse is the JSON representation of the channels a user has access to.
+type ChannelsResponse struct {
+	Channels []Facet `json:"channels"`
+}
+
+// UsersResponse is the JSON representation of the users that sent messages a user has access to.
+type UsersResponse struct {
+	Users []Facet `json:"users"`
+}
+
+// ErrorResponse is the JSON representation of an error.
+type ErrorResponse struct {
+	Error string `json:"error"`
 }
 
 type SearchRequest struct {
@@ -41,15 +130,51 @@ type SearchRequest struct {
 	From  time.Time `form:"from" json:"from" time_format:"2006-01-02"`
 	To    time.Time `form:"to" json:"to" time_format:"2006-01-02"`
 
-	Start int `form:"start"`
-	Next  int `form:"next"`
-	Prev  int `form:"prev"`
-	Page  int `form:"page"`
+	Channel string `form:"channel" json:"channel,omitempty"`
+	User    string `form:"user" json:"user,omitempty"`
+
+	Cursor string        `form:"cursor" json:"cursor,omitempty"`
+	Size   int           `form:"size" json:"size,omitempty"`
+	After  []interface{} `form:"-" json:"-"`
+	PIT    string        `form:"-" json:"-"`
+
+	FacetSize int `form:"-" json:"-"`
 
-	PrevNext           int    `form:"prev_next"`
-	BaseMessageTime    string `form:"base_message_time"`
-	BaseMessageChannel string `form:"base_message_channel"`
+	PrevNext           int    `form:"prev_next" json:"prev_next,omitempty"`
+	BaseMessageTime    string `form:"base_message_time" json:"base_message_time,omitempty"`
+	BaseMessageChannel string `form:"base_message_channel" json:"base_message_channel,omitempty"`
 
 	Index   string       `form:"-"`
 	Context *gin.Context `form:"-"`
 }
+
+// ErrInvalidBaseMessage is returned for a request for the messages around a message that does not say which message.
+var ErrInvalidBaseMessage = errors.New("base_message_channel and a numeric base_message_time are required")
+
+// ValidateBaseMessage checks that a request for the messages around a message names its channel and timestamp.
+func (r SearchRequest) ValidateBaseMessage() error {
+	if len(r.BaseMessageChannel) == 0 {
+		return ErrInvalidBaseMessage
+	}
+	if _, err := strconv.ParseFloat(r.BaseMessageTime, 64); err != nil {
+		return ErrInvalidBaseMessage
+	}
+	return nil
+}
+
+// DefaultFrom is the earliest date that is searched when a request does not specify one.
+const DefaultFrom = "2010-01-01"
+
+// today is the date that requests search until by default. Replaying a fixture sets it to the date the fixture
+// was recorded on, so that requests made on another day still match the ones that were recorded.
+var today = time.Now
+
+// SetDefaultDates searches from DefaultFrom until today when the dates of a request have not been specified.
+func (r *SearchRequest) SetDefaultDates() {
+	if r.From.IsZero() {
+		r.From, _ = time.Parse(DateFormat, DefaultFrom)
+	}
+	if r.To.IsZero() {
+		r.To, _ = time.Parse(DateFormat, today().Format(DateFormat))
+	}
+}